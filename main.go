@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/grafana/bigtable-backup/pkg/backup"
@@ -25,6 +26,21 @@ var (
 
 	deleteBackupsCmd  = app.Command("delete-backup", "Delete backup of a table with timestamp")
 	deleteBackupFlags = backup.RegisterDeleteBackupsFlags(deleteBackupsCmd)
+
+	inspectCmd      = app.Command("inspect", "Print the rows of a backup of a table")
+	inspectCmdFlags = backup.RegisterInspectBackupFlags(inspectCmd)
+
+	verifyCmd      = app.Command("verify", "Verify that all the SequenceFiles of a backup of a table can be read")
+	verifyCmdFlags = backup.RegisterVerifyBackupFlags(verifyCmd)
+
+	pruneCmd      = app.Command("prune", "Delete the backups which are not kept by any of the retention policies")
+	pruneCmdFlags = backup.RegisterPruneBackupsFlags(pruneCmd)
+
+	backfillManifestCmd      = app.Command("backfill-manifest", "Write the manifest of a backup made before manifests were written, which makes it complete")
+	backfillManifestCmdFlags = backup.RegisterBackfillManifestFlags(backfillManifestCmd)
+
+	serveCmd      = app.Command("serve", "Run the backups of a config file on their cron schedules and serve the HTTP API")
+	serveCmdFlags = backup.RegisterServeFlags(serveCmd)
 )
 
 func main() {
@@ -37,20 +53,41 @@ func main() {
 		if backups, err := backup.ListBackups(listBackupFlags); err != nil {
 			log.Fatalf("Error listing backups %v", err)
 		} else {
-			if strings.ToLower(listBackupFlags.OutputFormat) == "json" {
+			switch strings.ToLower(listBackupFlags.OutputFormat) {
+			case "json":
+				timestamps := make(map[string][]int64, len(backups))
+				for tableName, tableBackups := range backups {
+					for _, tableBackup := range tableBackups {
+						timestamps[tableName] = append(timestamps[tableName], tableBackup.Timestamp)
+					}
+				}
+				output, err := json.Marshal(timestamps)
+				if err != nil {
+					log.Fatalf("Failed to print backups in json format with error %v", err)
+				}
+				fmt.Printf("%s", output)
+			case "json-manifests":
 				output, err := json.Marshal(backups)
 				if err != nil {
 					log.Fatalf("Failed to print backups in json format with error %v", err)
 				}
 				fmt.Printf("%s", output)
-			} else {
+			default:
 				if len(backups) == 0 {
 					fmt.Println("No backups found")
 					return
 				}
-				fmt.Println("TableName: Backup Timestamps")
-				for tableName, backupTimestamps := range backups {
-					fmt.Printf("%s: %s\n", tableName, strings.Trim(strings.Replace(fmt.Sprint(backupTimestamps), " ", ",", -1), "[]"))
+				fmt.Println("TableName: Backup Timestamps (incomplete backups are marked with *)")
+				for tableName, tableBackups := range backups {
+					backupTimestamps := make([]string, 0, len(tableBackups))
+					for _, tableBackup := range tableBackups {
+						backupTimestamp := strconv.FormatInt(tableBackup.Timestamp, 10)
+						if !tableBackup.Complete() {
+							backupTimestamp += "*"
+						}
+						backupTimestamps = append(backupTimestamps, backupTimestamp)
+					}
+					fmt.Printf("%s: %s\n", tableName, strings.Join(backupTimestamps, ","))
 				}
 			}
 		}
@@ -62,5 +99,25 @@ func main() {
 		if err := backup.DeleteBackup(deleteBackupFlags); err != nil {
 			log.Fatalf("Error deleting backup %v", err)
 		}
+	case inspectCmd.FullCommand():
+		if err := backup.InspectBackup(inspectCmdFlags); err != nil {
+			log.Fatalf("Error inspecting backup %v", err)
+		}
+	case verifyCmd.FullCommand():
+		if err := backup.VerifyBackup(verifyCmdFlags); err != nil {
+			log.Fatalf("Error verifying backup %v", err)
+		}
+	case pruneCmd.FullCommand():
+		if err := backup.PruneBackups(pruneCmdFlags); err != nil {
+			log.Fatalf("Error pruning backups %v", err)
+		}
+	case backfillManifestCmd.FullCommand():
+		if err := backup.BackfillManifest(backfillManifestCmdFlags); err != nil {
+			log.Fatalf("Error backfilling manifest %v", err)
+		}
+	case serveCmd.FullCommand():
+		if err := backup.Serve(serveCmdFlags); err != nil {
+			log.Fatalf("Error serving %v", err)
+		}
 	}
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runMainEnv is set when the test binary is run as bigtable-backup by runMain.
+const runMainEnv = "BIGTABLE_BACKUP_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs bigtable-backup with the arguments in a new process and returns its output and exit code.
+func runMain(t *testing.T, args ...string) (string, int) {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), runMainEnv+"=1")
+	output, err := cmd.CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return string(output), exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(output), 0
+}
+
+func TestVerifyExitCode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bigtable-backup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "index_1", "100"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "index_1", "100", "index_1:-00000"), []byte("not a SequenceFile"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output, code := runMain(t, "verify", "--backup-path=file://"+dir, "--bigtable-table-id=index_1")
+	if code != 1 || !strings.Contains(output, "CORRUPT index_1/100/index_1:-00000") || !strings.Contains(output, "1 of 1 shards of the backup are corrupt") {
+		t.Errorf("Unexpected exit code %d with output:\n%s", code, output)
+	}
+}
+
+func TestDeleteBackupExitCode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bigtable-backup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	output, code := runMain(t, "delete-backup", "--backup-path=file://"+dir, "--bigtable-table-id=index_1", "--backup-timestamp=100/")
+	if code != 1 || !strings.Contains(output, `Invalid timestamp "100/" of the backup to delete`) {
+		t.Errorf("Unexpected exit code %d with output:\n%s", code, output)
+	}
+}
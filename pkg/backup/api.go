@@ -0,0 +1,401 @@
+package backup
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// States of the jobs of the HTTP API.
+const (
+	apiJobRunning   = "running"
+	apiJobSucceeded = "succeeded"
+	apiJobFailed    = "failed"
+)
+
+// apiJob is a create or restore triggered through the HTTP API.
+type apiJob struct {
+	ID         string      `json:"id"`
+	Type       string      `json:"type"`
+	State      string      `json:"state"`
+	Error      string      `json:"error,omitempty"`
+	StartedAt  time.Time   `json:"started_at"`
+	FinishedAt *time.Time  `json:"finished_at,omitempty"`
+	Request    interface{} `json:"request"`
+}
+
+// createBackupRequest is the body of POST /backups.
+type createBackupRequest struct {
+	BigtableProjectID     string `json:"bigtable_project_id"`
+	BigtableInstanceID    string `json:"bigtable_instance_id"`
+	BigtableTableIDPrefix string `json:"bigtable_table_id_prefix"`
+	// DestinationPath defaults to --backup-path of Serve command.
+	DestinationPath string `json:"destination_path"`
+	TempPrefix      string `json:"temp_prefix"`
+	JobLocation     string `json:"job_location"`
+	Runner          string `json:"runner"`
+	Parallelism     int    `json:"parallelism"`
+	// ContinueOnError defaults to true.
+	ContinueOnError *bool `json:"continue_on_error,omitempty"`
+}
+
+// restoreBackupRequest is the body of POST /restores.
+type restoreBackupRequest struct {
+	// BackupPath defaults to --backup-path of Serve command.
+	BackupPath         string `json:"backup_path"`
+	BigtableProjectID  string `json:"bigtable_project_id"`
+	BigtableInstanceID string `json:"bigtable_instance_id"`
+	BigtableTableID    string `json:"bigtable_table_id"`
+	// BackupTimestamp defaults to the most recent complete backup, made at or before AsOf if set.
+	BackupTimestamp          int64  `json:"backup_timestamp"`
+	AsOf                     string `json:"as_of"`
+	TargetBigtableProjectID  string `json:"target_bigtable_project_id"`
+	TargetBigtableInstanceID string `json:"target_bigtable_instance_id"`
+	TargetBigtableTableID    string `json:"target_bigtable_table_id"`
+	TempPrefix               string `json:"temp_prefix"`
+	JobLocation              string `json:"job_location"`
+	Runner                   string `json:"runner"`
+	CreateTable              bool   `json:"create_table"`
+	RowPrefix                string `json:"row_prefix"`
+	StartKey                 string `json:"start_key"`
+	EndKey                   string `json:"end_key"`
+}
+
+// api serves the JSON HTTP API, which lists, creates, restores and deletes backups.
+// Creates and restores run in the background as jobs, whose state is kept in memory until Serve exits.
+type api struct {
+	backupPath string
+	// allowedPaths are the only backup paths the requests can read and write.
+	allowedPaths  map[string]bool
+	enableRestore bool
+	enableDelete  bool
+	token         string
+
+	mtx    sync.Mutex
+	jobs   map[string]*apiJob
+	lastID int
+}
+
+func newAPI(config *ServeConfig) (*api, error) {
+	a := &api{
+		backupPath:    config.BackupPath,
+		allowedPaths:  map[string]bool{},
+		enableRestore: config.EnableRestoreAPI,
+		enableDelete:  config.EnableDeleteAPI,
+		jobs:          map[string]*apiJob{},
+	}
+	for _, path := range append([]string{config.BackupPath}, config.AllowedBackupPaths...) {
+		if path != "" {
+			a.allowedPaths[strings.TrimSuffix(path, "/")] = true
+		}
+	}
+
+	if config.APITokenFile != "" {
+		token, err := ioutil.ReadFile(config.APITokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading API token file %s with error: %s", config.APITokenFile, err)
+		}
+		if a.token = strings.TrimSpace(string(token)); a.token == "" {
+			return nil, fmt.Errorf("API token file %s is empty", config.APITokenFile)
+		}
+	}
+
+	return a, nil
+}
+
+func (a *api) register(mux *http.ServeMux) {
+	mux.HandleFunc("/backups", a.authenticate(a.handleBackups))
+	mux.HandleFunc("/backups/", a.authenticate(a.handleBackup))
+	mux.HandleFunc("/restores", a.authenticate(a.handleRestores))
+	mux.HandleFunc("/jobs/", a.authenticate(a.handleJob))
+}
+
+// authenticate only lets the requests with the bearer token through, if a token is set.
+func (a *api) authenticate(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.token != "" {
+			authorization := r.Header.Get("Authorization")
+			token := strings.TrimPrefix(authorization, "Bearer ")
+			if token == authorization || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeAPIError(w, http.StatusUnauthorized, errors.New("Invalid or missing bearer token"))
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+// resolveBackupPath returns the backup path of a request, which defaults to --backup-path and must be one of the allowed paths.
+// It writes the error response and returns false otherwise.
+func (a *api) resolveBackupPath(w http.ResponseWriter, path, field string) (string, bool) {
+	if path == "" {
+		path = a.backupPath
+	}
+	if path == "" {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("%s is required", field))
+		return "", false
+	}
+	if !a.allowedPaths[strings.TrimSuffix(path, "/")] {
+		writeAPIError(w, http.StatusForbidden, fmt.Errorf("Backup path %s is not allowed, it must be --backup-path or one of --api-allowed-backup-path", path))
+		return "", false
+	}
+	return path, true
+}
+
+// handleBackups serves GET /backups, which lists the backups with their manifests, and POST /backups, which creates backups.
+func (a *api) handleBackups(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		backupPath, ok := a.resolveBackupPath(w, r.URL.Query().Get("backup_path"), "backup_path")
+		if !ok {
+			return
+		}
+
+		backups, err := ListBackups(&ListBackupConfig{BackupPath: backupPath})
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeAPIResponse(w, http.StatusOK, backups)
+	case http.MethodPost:
+		var request createBackupRequest
+		if err := decodeAPIRequest(r, &request); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		if request.BigtableProjectID == "" || request.BigtableInstanceID == "" {
+			writeAPIError(w, http.StatusBadRequest, errors.New("bigtable_project_id and bigtable_instance_id are required"))
+			return
+		}
+		var ok bool
+		if request.DestinationPath, ok = a.resolveBackupPath(w, request.DestinationPath, "destination_path"); !ok {
+			return
+		}
+		if request.JobLocation == "" {
+			request.JobLocation = "us-central1"
+		}
+		if request.Runner == "" {
+			request.Runner = dataflowRunner
+		}
+
+		job := a.startJob("create", request, func() error {
+			return CreateBackup(&CreateBackupConfig{
+				BigtableProjectID:     request.BigtableProjectID,
+				BigtableInstanceID:    request.BigtableInstanceID,
+				BigtableTableIDPrefix: request.BigtableTableIDPrefix,
+				DestinationPath:       request.DestinationPath,
+				TempPrefix:            request.TempPrefix,
+				JobLocation:           request.JobLocation,
+				Runner:                request.Runner,
+				Parallelism:           request.Parallelism,
+				ContinueOnError:       request.ContinueOnError == nil || *request.ContinueOnError,
+			})
+		})
+		writeAPIResponse(w, http.StatusAccepted, job)
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+// handleBackup serves DELETE /backups/{table}/{timestamp}.
+func (a *api) handleBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeMethodNotAllowed(w, http.MethodDelete)
+		return
+	}
+	if !a.enableDelete {
+		writeAPIError(w, http.StatusForbidden, errors.New("Deleting backups is disabled, it is enabled by --api-enable-delete"))
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/backups/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("Unknown path %s", r.URL.Path))
+		return
+	}
+	tableID := parts[0]
+	timestamp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("Invalid backup timestamp %q", parts[1]))
+		return
+	}
+
+	backupPath, ok := a.resolveBackupPath(w, r.URL.Query().Get("backup_path"), "backup_path")
+	if !ok {
+		return
+	}
+
+	store, err := NewBackupStore(r.Context(), backupPath)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	timestamps, err := listBackupTimestamps(r.Context(), store, tableID)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !containsTimestamp(timestamps, timestamp) {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("No backup found for table %s with timestamp %d", tableID, timestamp))
+		return
+	}
+
+	err = DeleteBackup(&DeleteBackupConfig{
+		BigtableTableID: tableID,
+		BackupPath:      backupPath,
+		BackupTimestamp: strconv.FormatInt(timestamp, 10),
+	})
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRestores serves POST /restores, which restores a backup.
+func (a *api) handleRestores(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+	if !a.enableRestore {
+		writeAPIError(w, http.StatusForbidden, errors.New("Restoring backups is disabled, it is enabled by --api-enable-restore"))
+		return
+	}
+
+	var request restoreBackupRequest
+	if err := decodeAPIRequest(r, &request); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	if request.BigtableProjectID == "" || request.BigtableInstanceID == "" || request.BigtableTableID == "" {
+		writeAPIError(w, http.StatusBadRequest, errors.New("bigtable_project_id, bigtable_instance_id and bigtable_table_id are required"))
+		return
+	}
+	var ok bool
+	if request.BackupPath, ok = a.resolveBackupPath(w, request.BackupPath, "backup_path"); !ok {
+		return
+	}
+	if request.JobLocation == "" {
+		request.JobLocation = "us-central1"
+	}
+	if request.Runner == "" {
+		request.Runner = dataflowRunner
+	}
+
+	job := a.startJob("restore", request, func() error {
+		return RestoreBackup(&RestoreBackupConfig{
+			BackupPath:               request.BackupPath,
+			BigtableProjectID:        request.BigtableProjectID,
+			BigtableInstanceID:       request.BigtableInstanceID,
+			BigtableTableID:          request.BigtableTableID,
+			BackupTimestamp:          request.BackupTimestamp,
+			AsOf:                     request.AsOf,
+			TargetBigtableProjectID:  request.TargetBigtableProjectID,
+			TargetBigtableInstanceID: request.TargetBigtableInstanceID,
+			TargetBigtableTableID:    request.TargetBigtableTableID,
+			TempPrefix:               request.TempPrefix,
+			JobLocation:              request.JobLocation,
+			Runner:                   request.Runner,
+			CreateTable:              request.CreateTable,
+			RowPrefix:                request.RowPrefix,
+			StartKey:                 request.StartKey,
+			EndKey:                   request.EndKey,
+		})
+	})
+	writeAPIResponse(w, http.StatusAccepted, job)
+}
+
+// handleJob serves GET /jobs/{id}, which returns the state of a job.
+func (a *api) handleJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	a.mtx.Lock()
+	job, ok := a.jobs[id]
+	var snapshot apiJob
+	if ok {
+		snapshot = *job
+	}
+	a.mtx.Unlock()
+
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("No job found with Id %s", id))
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, &snapshot)
+}
+
+// startJob runs a create or restore in the background and returns a snapshot of its job.
+func (a *api) startJob(jobType string, request interface{}, run func() error) *apiJob {
+	a.mtx.Lock()
+	a.lastID++
+	job := &apiJob{
+		ID:        strconv.Itoa(a.lastID),
+		Type:      jobType,
+		State:     apiJobRunning,
+		StartedAt: time.Now().UTC(),
+		Request:   request,
+	}
+	a.jobs[job.ID] = job
+	snapshot := *job
+	a.mtx.Unlock()
+
+	log.Printf("Started %s job with Id %s", jobType, job.ID)
+	go func() {
+		err := run()
+
+		a.mtx.Lock()
+		defer a.mtx.Unlock()
+		finishedAt := time.Now().UTC()
+		job.FinishedAt = &finishedAt
+		if err != nil {
+			job.State = apiJobFailed
+			job.Error = err.Error()
+			log.Printf("Error running %s job with Id %s: %v", jobType, job.ID, err)
+			return
+		}
+		job.State = apiJobSucceeded
+		log.Printf("Finished %s job with Id %s", jobType, job.ID)
+	}()
+
+	return &snapshot
+}
+
+func decodeAPIRequest(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("Error parsing request with error: %s", err)
+	}
+	return nil
+}
+
+func writeAPIResponse(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing response with error: %s", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, code int, err error) {
+	writeAPIResponse(w, code, map[string]string{"error": err.Error()})
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeAPIError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+}
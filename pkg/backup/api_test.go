@@ -0,0 +1,189 @@
+package backup
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAPI(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+	otherStore, otherPath, otherCleanup := newTestStore(t)
+	defer otherCleanup()
+
+	writeTestBackup(t, store, "index_1", 100, 0, true)
+	writeTestBackup(t, otherStore, "index_1", 200, 0, true)
+	writeTestBackup(t, otherStore, "index_1", 300, 0, true)
+
+	for _, tc := range []struct {
+		name         string
+		config       ServeConfig
+		method       string
+		target       string
+		body         string
+		expectedCode int
+	}{
+		{
+			name:         "list the backup path",
+			config:       ServeConfig{BackupPath: path},
+			method:       http.MethodGet,
+			target:       "/backups",
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "list an allowed backup path",
+			config:       ServeConfig{BackupPath: path, AllowedBackupPaths: []string{otherPath + "/"}},
+			method:       http.MethodGet,
+			target:       "/backups?backup_path=" + url.QueryEscape(otherPath),
+			expectedCode: http.StatusOK,
+		},
+		{
+			name:         "list a backup path which is not allowed",
+			config:       ServeConfig{BackupPath: path},
+			method:       http.MethodGet,
+			target:       "/backups?backup_path=" + url.QueryEscape(otherPath),
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "list without backup path",
+			config:       ServeConfig{},
+			method:       http.MethodGet,
+			target:       "/backups",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "create in a backup path which is not allowed",
+			config:       ServeConfig{BackupPath: path},
+			method:       http.MethodPost,
+			target:       "/backups",
+			body:         `{"bigtable_project_id": "project", "bigtable_instance_id": "instance", "destination_path": "gs://other-bucket/backups"}`,
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "delete disabled",
+			config:       ServeConfig{BackupPath: path},
+			method:       http.MethodDelete,
+			target:       "/backups/index_1/100",
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "delete from a backup path which is not allowed",
+			config:       ServeConfig{BackupPath: path, EnableDeleteAPI: true},
+			method:       http.MethodDelete,
+			target:       "/backups/index_1/200?backup_path=" + url.QueryEscape(otherPath),
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "delete from an allowed backup path",
+			config:       ServeConfig{BackupPath: path, AllowedBackupPaths: []string{otherPath}, EnableDeleteAPI: true},
+			method:       http.MethodDelete,
+			target:       "/backups/index_1/300?backup_path=" + url.QueryEscape(otherPath),
+			expectedCode: http.StatusNoContent,
+		},
+		{
+			name:         "restore disabled",
+			config:       ServeConfig{BackupPath: path},
+			method:       http.MethodPost,
+			target:       "/restores",
+			body:         `{"bigtable_project_id": "project", "bigtable_instance_id": "instance", "bigtable_table_id": "index_1"}`,
+			expectedCode: http.StatusForbidden,
+		},
+		{
+			name:         "restore from a backup path which is not allowed",
+			config:       ServeConfig{BackupPath: path, EnableRestoreAPI: true},
+			method:       http.MethodPost,
+			target:       "/restores",
+			body:         `{"backup_path": "gs://other-bucket/backups", "bigtable_project_id": "project", "bigtable_instance_id": "instance", "bigtable_table_id": "index_1"}`,
+			expectedCode: http.StatusForbidden,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, err := newAPI(&tc.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mux := http.NewServeMux()
+			a.register(mux)
+
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body)))
+			if w.Code != tc.expectedCode {
+				t.Errorf("Got status %d instead of %d: %s", w.Code, tc.expectedCode, w.Body.String())
+			}
+		})
+	}
+
+	// Only the allowed delete went through.
+	for _, tc := range []struct {
+		store      BackupStore
+		timestamps []int64
+	}{
+		{store: store, timestamps: []int64{100}},
+		{store: otherStore, timestamps: []int64{200}},
+	} {
+		timestamps, err := listBackupTimestamps(context.Background(), tc.store, "index_1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(timestamps) != len(tc.timestamps) || timestamps[0] != tc.timestamps[0] {
+			t.Errorf("Got backups %v instead of %v", timestamps, tc.timestamps)
+		}
+	}
+}
+
+func TestAPIToken(t *testing.T) {
+	_, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "bigtable-backup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := newAPI(&ServeConfig{BackupPath: path, APITokenFile: tokenFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	a.register(mux)
+
+	for _, tc := range []struct {
+		authorization string
+		expectedCode  int
+	}{
+		{authorization: "", expectedCode: http.StatusUnauthorized},
+		{authorization: "Bearer wrong", expectedCode: http.StatusUnauthorized},
+		{authorization: "secret", expectedCode: http.StatusUnauthorized},
+		{authorization: "Bearer secret", expectedCode: http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/backups", nil)
+		if tc.authorization != "" {
+			r.Header.Set("Authorization", tc.authorization)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != tc.expectedCode {
+			t.Errorf("Got status %d instead of %d with authorization %q", w.Code, tc.expectedCode, tc.authorization)
+		}
+	}
+
+	// An empty token file is an error rather than no token.
+	if err := ioutil.WriteFile(tokenFile, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newAPI(&ServeConfig{BackupPath: path, APITokenFile: tokenFile}); err == nil {
+		t.Error("Expected an error with an empty token file")
+	}
+}
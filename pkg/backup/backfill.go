@@ -0,0 +1,83 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// BackfillManifestConfig has the config for BackfillManifest command.
+type BackfillManifestConfig struct {
+	BackupPath      string
+	BigtableTableID string
+	BackupTimestamp int64
+	// The schema of the table is recorded in the manifest when the project and instance of the table are set.
+	BigtableProjectID  string
+	BigtableInstanceID string
+}
+
+// RegisterBackfillManifestFlags registers the flags for BackfillManifest command.
+func RegisterBackfillManifestFlags(cmd *kingpin.CmdClause) *BackfillManifestConfig {
+	config := BackfillManifestConfig{}
+	cmd.Flag("backup-path", "Path where backups can be found. Supports gs:// and file:// paths").Required().StringVar(&config.BackupPath)
+	cmd.Flag("bigtable-table-id", "ID of the bigtable table of the backup").Required().StringVar(&config.BigtableTableID)
+	cmd.Flag("backup-timestamp", "Timestamp of the backup to write the manifest of").Required().Int64Var(&config.BackupTimestamp)
+	cmd.Flag("bigtable-project-id", "The ID of the GCP project of the table. When set with --bigtable-instance-id, "+
+		"the current schema of the table is recorded in the manifest").StringVar(&config.BigtableProjectID)
+	cmd.Flag("bigtable-instance-id", "The ID of the Cloud Bigtable instance of the table").StringVar(&config.BigtableInstanceID)
+	return &config
+}
+
+// BackfillManifest writes the manifest of a backup made before manifests were written, which makes it complete.
+// It does not check that the backup has all its SequenceFiles, so the backup should be verified first.
+func BackfillManifest(config *BackfillManifestConfig) error {
+	ctx := context.Background()
+	store, err := NewBackupStore(ctx, config.BackupPath)
+	if err != nil {
+		return err
+	}
+
+	existing, err := readManifest(ctx, store, config.BigtableTableID, config.BackupTimestamp)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("Backup of table %s with timestamp %d already has a manifest", config.BigtableTableID, config.BackupTimestamp)
+	}
+
+	shards, err := listShards(ctx, store, config.BigtableTableID, config.BackupTimestamp)
+	if err != nil {
+		return err
+	}
+	if len(shards) == 0 {
+		return fmt.Errorf("No SequenceFiles found for table %s with timestamp %d", config.BigtableTableID, config.BackupTimestamp)
+	}
+
+	manifest := &Manifest{
+		BigtableProjectID:  config.BigtableProjectID,
+		BigtableInstanceID: config.BigtableInstanceID,
+		BigtableTableID:    config.BigtableTableID,
+		Timestamp:          config.BackupTimestamp,
+		Shards:             shards,
+		Version:            Version,
+		CreatedAt:          time.Now().UTC(),
+		Backfilled:         true,
+	}
+	if config.BigtableProjectID != "" && config.BigtableInstanceID != "" {
+		schema, err := newTableAdmin(config.BigtableProjectID, config.BigtableInstanceID).GetTableSchema(ctx, config.BigtableTableID)
+		if err != nil {
+			return fmt.Errorf("Error getting schema of table with Id %s with error: %s", config.BigtableTableID, err)
+		}
+		manifest.ColumnFamilies = schema.ColumnFamilies
+		manifest.Granularity = schema.Granularity
+	}
+
+	if err := writeManifest(ctx, store, manifest); err != nil {
+		return fmt.Errorf("Error writing manifest of backup of table with Id %s with error: %s", config.BigtableTableID, err)
+	}
+	fmt.Printf("Manifest written for backup of table %s with timestamp %d with %d SequenceFiles\n", config.BigtableTableID, config.BackupTimestamp, len(shards))
+
+	return nil
+}
@@ -0,0 +1,41 @@
+package backup
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBackfillManifest(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	writeTestBackup(t, store, "index_1", 50, 0, true)
+	writeTestBackup(t, store, "index_1", 100, 0, false)
+	if timestamp, err := getNewestBackupTimestamp(path, "index_1", time.Time{}); err != nil || *timestamp != 50 {
+		t.Fatalf("Expected a backup without manifest not to be restored, got %v", err)
+	}
+
+	config := &BackfillManifestConfig{BackupPath: path, BigtableTableID: "index_1", BackupTimestamp: 100}
+	if err := BackfillManifest(config); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := readManifest(context.Background(), store, "index_1", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest == nil || !manifest.Backfilled || len(manifest.Shards) != 1 || manifest.Shards[0].CRC32C == "" {
+		t.Fatalf("Unexpected manifest %+v", manifest)
+	}
+	if timestamp, err := getNewestBackupTimestamp(path, "index_1", time.Time{}); err != nil || *timestamp != 100 {
+		t.Errorf("Expected the backfilled backup to be restored, got %v", err)
+	}
+
+	if err := BackfillManifest(config); err == nil {
+		t.Error("Expected an error backfilling the manifest of a complete backup")
+	}
+	if err := BackfillManifest(&BackfillManifestConfig{BackupPath: path, BigtableTableID: "index_1", BackupTimestamp: 200}); err == nil {
+		t.Error("Expected an error backfilling the manifest of a missing backup")
+	}
+}
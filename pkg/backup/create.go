@@ -2,21 +2,23 @@ package backup
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/alecthomas/kingpin.v2"
-
-	bigtableAdminV2 "google.golang.org/api/bigtableadmin/v2"
-	dataflowV1b3 "google.golang.org/api/dataflow/v1b3"
 )
 
 const (
-	bigtableToGCSSequenceFileTemplatePath = "gs://dataflow-templates/latest/Cloud_Bigtable_to_GCS_SequenceFile"
-	bigtableIDSeparatorInSeqFileName      = ":"
-	jobStateCheckDuration                 = 10 * time.Second
+	bigtableIDSeparatorInSeqFileName = ":"
+	jobStateCheckDuration            = 10 * time.Second
 )
 
 // CreateBackupConfig is the config for CreateBackup command.
@@ -27,6 +29,38 @@ type CreateBackupConfig struct {
 	DestinationPath       string
 	TempPrefix            string
 	JobLocation           string
+	Runner                string
+	Parallelism           int
+	ReportFile            string
+	PushgatewayURL        string
+	// ContinueOnError backs up all the tables even if some of them fail. Otherwise the remaining tables are skipped
+	// once a table fails. The flag of the command and the JSON configs of serve default to true.
+	ContinueOnError bool
+	// IncrementalSince is the timestamp of the backup to back up incrementally from. Zero makes full backups.
+	IncrementalSince int64
+	// PeriodicTables selects the periodic tables with the prefix to back up.
+	PeriodicTables PeriodicTableConfig
+	// SkipUnchanged skips the periodic tables with a complete backup made after they stopped being written to.
+	SkipUnchanged bool
+
+	// The tables with the prefix are only backed up if they match one of IncludeRegexes, none of ExcludeRegexes
+	// and are one of Tables. Empty lists do not filter the tables.
+	IncludeRegexes []string
+	ExcludeRegexes []string
+	Tables         []string
+	// ListOnly prints the IDs of the tables which would be backed up instead of backing them up.
+	ListOnly bool
+
+	// JobRunner launches the export jobs. Defaults to the runner named by Runner.
+	JobRunner JobRunner
+	// JobStateCheckInterval is how often the states of the export jobs are polled. Defaults to 10 seconds.
+	JobStateCheckInterval time.Duration
+	// TableAdmin looks up the tables and their schemas. Defaults to the admin API of the instance.
+	TableAdmin TableAdmin
+
+	// output is where the progress and the summary of the backups are printed.
+	// It is stderr when the report or the list of tables is written to stdout, so that stdout only has them.
+	output io.Writer
 }
 
 // RegisterCreateBackupFlags registers the flags for CreateBackup command.
@@ -37,101 +71,332 @@ func RegisterCreateBackupFlags(cmd *kingpin.CmdClause) *CreateBackupConfig {
 	cmd.Flag("bigtable-table-id-prefix",
 		"Prefix to find the IDs of the Cloud Bigtable table to export. "+
 			"It can be a table name to backup specific table or prefix to backup all tables matching the prefix.").Required().StringVar(&config.BigtableTableIDPrefix)
-	cmd.Flag("destination-path", "GCS path where data should be written. For example, \"gs://mybucket/somefolder/\"").Required().StringVar(&config.DestinationPath)
-	cmd.Flag("temp-prefix", "Path and filename prefix for writing temporary files. ex: gs://MyBucket/tmp").Required().StringVar(&config.TempPrefix)
+	cmd.Flag("destination-path", "Path where data should be written. For example, \"gs://mybucket/somefolder/\". "+
+		"file:// paths are only supported by the local runner").Required().StringVar(&config.DestinationPath)
+	cmd.Flag("temp-prefix", "Path and filename prefix for writing temporary files. ex: gs://MyBucket/tmp. Required by the dataflow runner").StringVar(&config.TempPrefix)
 	cmd.Flag("job-location", "Location where we want to run the job e.g us-central1, europe-west1").Default("us-central1").StringVar(&config.JobLocation)
+	cmd.Flag("runner", "Runner for the export jobs. Either dataflow or local, which exports the tables in-process").Default(dataflowRunner).EnumVar(&config.Runner, dataflowRunner, localRunner)
+	cmd.Flag("parallelism", "Maximum number of export jobs running at once").Default("1").IntVar(&config.Parallelism)
+	cmd.Flag("continue-on-error", "Back up all the tables even if some of them fail. "+
+		"Use --no-continue-on-error to skip the remaining tables once a table fails").Default("true").BoolVar(&config.ContinueOnError)
+	cmd.Flag("pushgateway-url", "URL of the Prometheus Pushgateway to push the metrics of the backups to").StringVar(&config.PushgatewayURL)
+	cmd.Flag("incremental-since", "Timestamp of a complete backup of the tables to only back up the cells written since. "+
+		"Only supported by the local runner").Int64Var(&config.IncrementalSince)
+	registerPeriodicTableFlags(cmd, &config.PeriodicTables)
+	cmd.Flag("skip-unchanged", "Skip the periodic tables with a complete backup made after they stopped being written to. "+
+		"Requires --periodic-table-period").BoolVar(&config.SkipUnchanged)
+	cmd.Flag("include-regex", "Only back up the tables with IDs fully matching one of these regular expressions. Can be repeated").StringsVar(&config.IncludeRegexes)
+	cmd.Flag("exclude-regex", "Do not back up the tables with IDs fully matching any of these regular expressions. Can be repeated").StringsVar(&config.ExcludeRegexes)
+	cmd.Flag("table", "Only back up the tables with these IDs. Can be repeated").StringsVar(&config.Tables)
+	cmd.Flag("list-only", "Only print the IDs of the tables which would be backed up").BoolVar(&config.ListOnly)
+	cmd.Flag("report-file", "File where the JSON report of the backup of every table is written. Use - for stdout").StringVar(&config.ReportFile)
 
 	return &config
 }
 
 // CreateBackup creates the backup.
 func CreateBackup(config *CreateBackupConfig) error {
-	config.DestinationPath = strings.TrimSuffix(config.DestinationPath, "/")
 	unixNow := time.Now().Unix()
 
+	if config.IncrementalSince != 0 && config.JobRunner == nil && config.Runner != localRunner {
+		return errors.New("Incremental backups are only supported by the local runner")
+	}
+	if config.SkipUnchanged && config.PeriodicTables.Period <= 0 {
+		return errors.New("Skipping unchanged tables requires the period of the periodic tables")
+	}
+
+	config.output = os.Stdout
+	if config.ReportFile == "-" || config.ListOnly {
+		config.output = os.Stderr
+	}
+	if config.TableAdmin == nil {
+		config.TableAdmin = newTableAdmin(config.BigtableProjectID, config.BigtableInstanceID)
+	}
+
 	tableIDs, err := listTableIDsWithPrefix(config)
 	if err != nil {
 		return err
 	}
+	if tableIDs, err = filterTableIDs(config, tableIDs); err != nil {
+		return err
+	}
 
 	if len(tableIDs) == 0 {
 		return errors.New("No tables found")
 	}
 
+	results := make([]tableBackupResult, len(tableIDs))
+	for i, tableID := range tableIDs {
+		results[i].TableID = tableID
+	}
+
+	if config.SkipUnchanged {
+		if err := skipUnchangedTables(config, results); err != nil {
+			return err
+		}
+	}
+
+	// The skipped tables are left out of the list, and their skip reasons are printed to stderr.
+	if config.ListOnly {
+		for _, result := range results {
+			if !result.Skipped {
+				fmt.Println(result.TableID)
+			}
+		}
+		return nil
+	}
+
+	if config.Parallelism < 1 {
+		config.Parallelism = 1
+	}
+
 	ctx := context.Background()
-	service, err := dataflowV1b3.NewService(ctx)
+	store, err := NewBackupStore(ctx, config.DestinationPath)
 	if err != nil {
 		return err
 	}
 
-	var jobFailureStates = map[string]struct{}{"JOB_STATE_FAILED": {}, "JOB_STATE_CANCELLED": {}, "JOB_STATE_CANCELLING": {}}
-
-	for _, tableID := range tableIDs {
-		jobName := fmt.Sprintf("export-%s-%d", tableID, unixNow)
-		destinationPathWithTimestamp := fmt.Sprintf("%s/%s/%d/", config.DestinationPath, tableID, unixNow)
-		createJobFromTemplateRequest := dataflowV1b3.CreateJobFromTemplateRequest{
-			JobName: jobName,
-			GcsPath: bigtableToGCSSequenceFileTemplatePath,
-			Parameters: map[string]string{
-				"bigtableProject":    config.BigtableProjectID,
-				"bigtableInstanceId": config.BigtableInstanceID,
-				"bigtableTableId":    tableID,
-				"destinationPath":    destinationPathWithTimestamp,
-				"filenamePrefix":     tableID + bigtableIDSeparatorInSeqFileName,
-			},
-			Environment: &dataflowV1b3.RuntimeEnvironment{
-				TempLocation: config.TempPrefix,
-			},
-			Location: config.JobLocation,
-		}
-
-		job, err := service.Projects.Templates.Create(config.BigtableProjectID, &createJobFromTemplateRequest).Do()
+	runner := config.JobRunner
+	if runner == nil {
+		runner, err = newJobRunner(ctx, config.Runner, config.BigtableProjectID, config.JobLocation, config.TempPrefix)
 		if err != nil {
-			return fmt.Errorf("Error backing up table with Id %s with error: %s", tableID, err)
+			return err
 		}
-		fmt.Printf("Created job for backing up %s with timestamp %d\n", tableID, unixNow)
+	}
 
-		// Polling state of the job until its done or fails
-		for {
-			fetchedJob, err := service.Projects.Locations.Jobs.Get(config.BigtableProjectID, config.JobLocation, job.Id).Do()
-			if err != nil {
-				return fmt.Errorf("Error getting state of the job with Id %s with error: %s", job.Id, err)
-			}
+	// Unless continuing on errors, once a table fails the jobs already running are waited for and the remaining tables are skipped.
+	var (
+		wg     sync.WaitGroup
+		mtx    sync.Mutex
+		failed bool
+	)
+	limit := make(chan struct{}, config.Parallelism)
+	for i := range results {
+		if results[i].Skipped {
+			continue
+		}
+		limit <- struct{}{}
 
-			if state, isOK := jobFailureStates[fetchedJob.CurrentState]; isOK {
-				return fmt.Errorf("Data flow job failed with state %s", state)
-			}
-			if fetchedJob.CurrentState == "JOB_STATE_DONE" {
-				break
+		mtx.Lock()
+		skip := failed && !config.ContinueOnError
+		mtx.Unlock()
+		if skip {
+			results[i].Skipped = true
+			<-limit
+			continue
+		}
+
+		wg.Add(1)
+		go func(result *tableBackupResult) {
+			defer wg.Done()
+			defer func() { <-limit }()
+
+			start := time.Now()
+			result.JobID, result.State, result.err = backupTable(ctx, config, store, runner, result.TableID, unixNow)
+			result.Duration = time.Since(start).Seconds()
+			if result.err != nil {
+				result.Error = result.err.Error()
+				mtx.Lock()
+				failed = true
+				mtx.Unlock()
 			}
+		}(&results[i])
+	}
+	wg.Wait()
 
-			fmt.Printf("Current job state: %s\n", fetchedJob.CurrentState)
+	grouping := map[string]string{"command": "create"}
+	if config.BigtableTableIDPrefix != "" {
+		grouping["prefix"] = config.BigtableTableIDPrefix
+	}
+	pushMetrics(config.PushgatewayURL, grouping)
 
-			time.Sleep(jobStateCheckDuration)
+	if config.ReportFile != "" {
+		if err := writeBackupReport(config.ReportFile, &backupReport{Timestamp: unixNow, Tables: results}); err != nil {
+			return err
 		}
-		fmt.Printf("Job for backing up %s with timestamp %d finished\n", tableID, unixNow)
 	}
 
+	return printTableBackupResults(config.output, results, unixNow)
+}
+
+// tableBackupResult is the result of the backup of a table.
+type tableBackupResult struct {
+	TableID  string   `json:"table_id"`
+	JobID    string   `json:"job_id,omitempty"`
+	State    JobState `json:"state,omitempty"`
+	Duration float64  `json:"duration_seconds"`
+	Error    string   `json:"error,omitempty"`
+	Skipped  bool     `json:"skipped,omitempty"`
+	// SkipReason is set when the table is skipped for another reason than a failure of another table.
+	SkipReason string `json:"skip_reason,omitempty"`
+
+	err error
+}
+
+// backupReport is the report of the backup of all the tables.
+type backupReport struct {
+	Timestamp int64               `json:"timestamp"`
+	Tables    []tableBackupResult `json:"tables"`
+}
+
+func writeBackupReport(path string, report *backupReport) error {
+	output, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	output = append(output, '\n')
+
+	if path == "-" {
+		_, err = os.Stdout.Write(output)
+		return err
+	}
+	return ioutil.WriteFile(path, output, 0644)
+}
+
+// printTableBackupResults prints the result of the backup of every table, and returns an error if any failed.
+func printTableBackupResults(w io.Writer, results []tableBackupResult, unixNow int64) error {
+	failures := 0
+	fmt.Fprintf(w, "Summary of backups with timestamp %d:\n", unixNow)
+	for _, result := range results {
+		switch {
+		case result.Skipped && result.SkipReason != "":
+			fmt.Fprintf(w, "%s: skipped, %s\n", result.TableID, result.SkipReason)
+		case result.Skipped:
+			fmt.Fprintf(w, "%s: skipped\n", result.TableID)
+		case result.err != nil:
+			failures++
+			fmt.Fprintf(w, "%s: failed: %s\n", result.TableID, result.err)
+		default:
+			fmt.Fprintf(w, "%s: done with job %s\n", result.TableID, result.JobID)
+		}
+	}
+
+	if failures > 0 {
+		return fmt.Errorf("Failed to back up %d of %d tables", failures, len(results))
+	}
 	return nil
 }
 
-func listTableIDsWithPrefix(config *CreateBackupConfig) ([]string, error) {
+// skipUnchangedTables skips the periodic tables whose newest complete backup was made after they stopped being written to.
+func skipUnchangedTables(config *CreateBackupConfig, results []tableBackupResult) error {
 	ctx := context.Background()
-	service, err := bigtableAdminV2.NewService(ctx)
+	store, err := NewBackupStore(ctx, config.DestinationPath)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	for i := range results {
+		period, ok := tablePeriod(results[i].TableID, config.BigtableTableIDPrefix)
+		if !ok {
+			continue
+		}
+
+		backup, err := newestCompleteBackup(ctx, store, results[i].TableID, time.Time{})
+		if err != nil {
+			return err
+		}
+		if backup == nil || time.Unix(backup.Timestamp, 0).Before(config.PeriodicTables.writtenUntil(period)) {
+			continue
+		}
+
+		results[i].Skipped = true
+		results[i].SkipReason = fmt.Sprintf("unchanged since backup with timestamp %d", backup.Timestamp)
+		fmt.Fprintf(config.output, "Skipping %s, it is unchanged since its backup with timestamp %d\n", results[i].TableID, backup.Timestamp)
+		// The existing backup is still the last successful backup of the table.
+		lastSuccessfulBackupTimestamp.WithLabelValues(results[i].TableID).Set(float64(backup.Timestamp))
+	}
+
+	return nil
+}
+
+// backupTable exports a table, waits for the export job to finish and writes the manifest of the backup.
+func backupTable(ctx context.Context, config *CreateBackupConfig, store BackupStore, runner JobRunner, tableID string, unixNow int64) (string, JobState, error) {
+	schema, err := config.TableAdmin.GetTableSchema(ctx, tableID)
+	if err != nil {
+		return "", "", fmt.Errorf("Error getting schema of table with Id %s with error: %s", tableID, err)
 	}
 
-	parent := "projects/" + config.BigtableProjectID + "/instances/" + config.BigtableInstanceID
-	listTableResponse, err := service.Projects.Instances.Tables.List(parent).Do()
+	exportJob := &ExportJob{
+		Name:               fmt.Sprintf("export-%s-%d", tableID, unixNow),
+		BigtableProjectID:  config.BigtableProjectID,
+		BigtableInstanceID: config.BigtableInstanceID,
+		BigtableTableID:    tableID,
+		DestinationPath:    store.URL(fmt.Sprintf("%s/%d/", tableID, unixNow)),
+		FilenamePrefix:     tableID + bigtableIDSeparatorInSeqFileName,
+	}
+	if config.IncrementalSince != 0 {
+		// The cells written while the parent backup was running may not be in it, so they are exported again.
+		parent, err := readManifest(ctx, store, tableID, config.IncrementalSince)
+		if err != nil {
+			return "", "", err
+		}
+		if parent == nil {
+			return "", "", fmt.Errorf("No complete backup of table with Id %s with timestamp %d to back up incrementally from", tableID, config.IncrementalSince)
+		}
+		exportJob.StartTime = time.Unix(config.IncrementalSince, 0)
+	}
+
+	launched := time.Now()
+	jobID, err := runner.LaunchExport(ctx, exportJob)
+	if err != nil {
+		recordJobFailure(exportJobType, "")
+		return "", "", fmt.Errorf("Error backing up table with Id %s with error: %s", tableID, err)
+	}
+	fmt.Fprintf(config.output, "Created job for backing up %s with timestamp %d\n", tableID, unixNow)
+
+	state, err := waitForJob(ctx, runner, jobID, config.JobStateCheckInterval, config.output)
+	if err != nil {
+		recordJobFailure(exportJobType, state)
+		return jobID, state, err
+	}
+	jobDuration.WithLabelValues(exportJobType).Observe(time.Since(launched).Seconds())
+	fmt.Fprintf(config.output, "Job for backing up %s with timestamp %d finished\n", tableID, unixNow)
+
+	shards, err := listShards(ctx, store, tableID, unixNow)
+	if err != nil {
+		return jobID, state, err
+	}
+	manifest := &Manifest{
+		BigtableProjectID:  config.BigtableProjectID,
+		BigtableInstanceID: config.BigtableInstanceID,
+		BigtableTableID:    tableID,
+		Timestamp:          unixNow,
+		Runner:             config.Runner,
+		JobID:              jobID,
+		Shards:             shards,
+		Version:            Version,
+		ColumnFamilies:     schema.ColumnFamilies,
+		Granularity:        schema.Granularity,
+		CreatedAt:          time.Now().UTC(),
+		Parent:             config.IncrementalSince,
+	}
+	if _, ok := runner.(*DataflowJobRunner); ok {
+		manifest.TemplatePath = bigtableToGCSSequenceFileTemplatePath
+	}
+	if err := writeManifest(ctx, store, manifest); err != nil {
+		return jobID, state, fmt.Errorf("Error writing manifest of backup of table with Id %s with error: %s", tableID, err)
+	}
+
+	lastSuccessfulBackupTimestamp.WithLabelValues(tableID).Set(float64(unixNow))
+	for _, shard := range shards {
+		backupBytes.WithLabelValues(tableID).Add(float64(shard.Size))
+	}
+
+	return jobID, state, nil
+}
+
+func listTableIDsWithPrefix(config *CreateBackupConfig) ([]string, error) {
+	allTableIDs, err := config.TableAdmin.ListTables(context.Background())
 	if err != nil {
 		return nil, err
 	}
 
-	tableIDs := make([]string, 0, len(listTableResponse.Tables))
-	tableID := ""
-	for _, table := range listTableResponse.Tables {
-		tableID = table.Name[strings.LastIndex(table.Name, "/")+1:]
+	if config.PeriodicTables.Period > 0 {
+		return selectPeriodicTables(allTableIDs, config.BigtableTableIDPrefix, &config.PeriodicTables, time.Now())
+	}
+
+	tableIDs := make([]string, 0, len(allTableIDs))
+	for _, tableID := range allTableIDs {
 		if strings.HasPrefix(tableID, config.BigtableTableIDPrefix) {
 			tableIDs = append(tableIDs, tableID)
 		}
@@ -139,3 +404,65 @@ func listTableIDsWithPrefix(config *CreateBackupConfig) ([]string, error) {
 
 	return tableIDs, nil
 }
+
+// filterTableIDs returns the tables selected by the regular expressions and table IDs of the config, in order.
+func filterTableIDs(config *CreateBackupConfig, tableIDs []string) ([]string, error) {
+	includeRegexes, err := compileTableIDRegexes(config.IncludeRegexes)
+	if err != nil {
+		return nil, err
+	}
+	excludeRegexes, err := compileTableIDRegexes(config.ExcludeRegexes)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]bool, len(tableIDs))
+	for _, tableID := range tableIDs {
+		found[tableID] = true
+	}
+	tables := make(map[string]bool, len(config.Tables))
+	for _, tableID := range config.Tables {
+		if !found[tableID] {
+			return nil, fmt.Errorf("Table with Id %s not found with prefix %s", tableID, config.BigtableTableIDPrefix)
+		}
+		tables[tableID] = true
+	}
+
+	filtered := make([]string, 0, len(tableIDs))
+	for _, tableID := range tableIDs {
+		if len(tables) > 0 && !tables[tableID] {
+			continue
+		}
+		if len(includeRegexes) > 0 && !matchesAny(includeRegexes, tableID) {
+			continue
+		}
+		if matchesAny(excludeRegexes, tableID) {
+			continue
+		}
+		filtered = append(filtered, tableID)
+	}
+
+	return filtered, nil
+}
+
+// compileTableIDRegexes compiles regular expressions which have to match the whole table IDs.
+func compileTableIDRegexes(exprs []string) ([]*regexp.Regexp, error) {
+	regexes := make([]*regexp.Regexp, 0, len(exprs))
+	for _, expr := range exprs {
+		regex, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("Invalid regular expression %s with error: %s", expr, err)
+		}
+		regexes = append(regexes, regex)
+	}
+	return regexes, nil
+}
+
+func matchesAny(regexes []*regexp.Regexp, s string) bool {
+	for _, regex := range regexes {
+		if regex.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,339 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	bigtableAdminV2 "google.golang.org/api/bigtableadmin/v2"
+)
+
+// fakeTableAdmin is a TableAdmin serving the tables it has been given.
+type fakeTableAdmin map[string]*bigtableAdminV2.Table
+
+func (a fakeTableAdmin) ListTables(ctx context.Context) ([]string, error) {
+	tableIDs := make([]string, 0, len(a))
+	for tableID := range a {
+		tableIDs = append(tableIDs, tableID)
+	}
+	sort.Strings(tableIDs)
+	return tableIDs, nil
+}
+
+func (a fakeTableAdmin) GetTableSchema(ctx context.Context, tableID string) (*bigtableAdminV2.Table, error) {
+	table, ok := a[tableID]
+	if !ok {
+		return nil, fmt.Errorf("Table with Id %s not found", tableID)
+	}
+	return table, nil
+}
+
+// newTestStore returns a BackupStore in a temporary directory, with its file:// path.
+func newTestStore(t *testing.T) (BackupStore, string, func()) {
+	dir, err := ioutil.TempDir("", "bigtable-backup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := localScheme + dir
+	store, err := NewBackupStore(context.Background(), path)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return store, path, func() { os.RemoveAll(dir) }
+}
+
+// writeTestBackup writes a backup with a single shard, and its manifest unless the backup is incomplete.
+func writeTestBackup(t *testing.T, store BackupStore, tableID string, timestamp, parent int64, complete bool) {
+	writeTestObject(t, store, fmt.Sprintf("%s/%d/%s%s0", tableID, timestamp, tableID, bigtableIDSeparatorInSeqFileName))
+	if !complete {
+		return
+	}
+
+	ctx := context.Background()
+	shards, err := listShards(ctx, store, tableID, timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeManifest(ctx, store, &Manifest{BigtableTableID: tableID, Timestamp: timestamp, Shards: shards, Parent: parent})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTestObject(t *testing.T, store BackupStore, name string) {
+	w, err := store.NewWriter(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(name)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// captureStdout returns what f writes to stdout.
+func captureStdout(t *testing.T, f func()) []byte {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		output <- data
+	}()
+
+	f()
+	w.Close()
+	return <-output
+}
+
+func testTableAdmin() fakeTableAdmin {
+	schema := &bigtableAdminV2.Table{ColumnFamilies: map[string]bigtableAdminV2.ColumnFamily{
+		"f": {GcRule: &bigtableAdminV2.GcRule{MaxNumVersions: 1}},
+	}}
+	return fakeTableAdmin{"index_1": schema, "index_2": schema, "index_3": schema, "chunks_1": schema}
+}
+
+func TestCreateBackup(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	runner := NewFakeJobRunner()
+	config := &CreateBackupConfig{
+		BigtableProjectID:     "project",
+		BigtableInstanceID:    "instance",
+		BigtableTableIDPrefix: "index_",
+		DestinationPath:       path,
+		ExcludeRegexes:        []string{"index_3"},
+		JobRunner:             runner,
+		JobStateCheckInterval: time.Millisecond,
+		TableAdmin:            testTableAdmin(),
+	}
+	if err := CreateBackup(config); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs := runner.ExportJobs()
+	var tableIDs []string
+	for _, job := range jobs {
+		tableIDs = append(tableIDs, job.BigtableTableID)
+		if !strings.HasPrefix(job.DestinationPath, store.URL(job.BigtableTableID+"/")) {
+			t.Errorf("Export job of table %s writes to %s", job.BigtableTableID, job.DestinationPath)
+		}
+		if job.FilenamePrefix != job.BigtableTableID+bigtableIDSeparatorInSeqFileName {
+			t.Errorf("Export job of table %s has filename prefix %s", job.BigtableTableID, job.FilenamePrefix)
+		}
+	}
+	sort.Strings(tableIDs)
+	if expected := []string{"index_1", "index_2"}; !reflect.DeepEqual(tableIDs, expected) {
+		t.Fatalf("Exported tables %v instead of %v", tableIDs, expected)
+	}
+
+	backups, err := ListBackups(&ListBackupConfig{BackupPath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tableID := range []string{"index_1", "index_2"} {
+		if len(backups[tableID]) != 1 || !backups[tableID][0].Complete() {
+			t.Fatalf("Expected one complete backup of %s, got %+v", tableID, backups[tableID])
+		}
+		manifest := backups[tableID][0].Manifest
+		if manifest.BigtableProjectID != "project" || manifest.ColumnFamilies["f"].GcRule.MaxNumVersions != 1 {
+			t.Errorf("Unexpected manifest of the backup of %s: %+v", tableID, manifest)
+		}
+	}
+}
+
+func TestCreateBackupIncremental(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	// index_1 has a complete backup to back up incrementally from, index_2 an incomplete one and index_3 none.
+	writeTestBackup(t, store, "index_1", 100, 0, true)
+	writeTestBackup(t, store, "index_2", 100, 0, false)
+
+	runner := NewFakeJobRunner()
+	config := &CreateBackupConfig{
+		BigtableProjectID:     "project",
+		BigtableInstanceID:    "instance",
+		BigtableTableIDPrefix: "index_",
+		DestinationPath:       path,
+		IncrementalSince:      100,
+		ContinueOnError:       true,
+		JobRunner:             runner,
+		JobStateCheckInterval: time.Millisecond,
+		TableAdmin:            testTableAdmin(),
+	}
+	err := CreateBackup(config)
+	if err == nil || err.Error() != "Failed to back up 2 of 3 tables" {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	jobs := runner.ExportJobs()
+	if len(jobs) != 1 || jobs[0].BigtableTableID != "index_1" || !jobs[0].StartTime.Equal(time.Unix(100, 0)) {
+		t.Fatalf("Unexpected export jobs %+v", jobs)
+	}
+
+	backups, err := ListBackups(&ListBackupConfig{BackupPath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups["index_1"]) != 2 || !backups["index_1"][1].Complete() || backups["index_1"][1].Manifest.Parent != 100 {
+		t.Errorf("Expected an incremental backup of index_1 with parent 100, got %+v", backups["index_1"])
+	}
+	if len(backups["index_2"]) != 1 || len(backups["index_3"]) != 0 {
+		t.Errorf("Expected no backup of the tables without a complete parent, got %+v and %+v", backups["index_2"], backups["index_3"])
+	}
+}
+
+func TestCreateBackupFailure(t *testing.T) {
+	_, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	runner := NewFakeJobRunner()
+	runner.JobStates["index_1"] = []JobState{JobStatePending, JobStateRunning, JobStateFailed}
+	config := &CreateBackupConfig{
+		BigtableProjectID:     "project",
+		BigtableInstanceID:    "instance",
+		BigtableTableIDPrefix: "index_",
+		DestinationPath:       path,
+		ContinueOnError:       true,
+		JobRunner:             runner,
+		JobStateCheckInterval: time.Millisecond,
+		TableAdmin:            testTableAdmin(),
+	}
+	err := CreateBackup(config)
+	if err == nil || err.Error() != "Failed to back up 1 of 3 tables" {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	backups, err := ListBackups(&ListBackupConfig{BackupPath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups["index_1"]) != 0 {
+		t.Errorf("Expected no backup of the failed table, got %+v", backups["index_1"])
+	}
+	for _, tableID := range []string{"index_2", "index_3"} {
+		if len(backups[tableID]) != 1 || !backups[tableID][0].Complete() {
+			t.Errorf("Expected one complete backup of %s, got %+v", tableID, backups[tableID])
+		}
+	}
+}
+
+func TestCreateBackupStopOnError(t *testing.T) {
+	_, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	runner := NewFakeJobRunner()
+	runner.JobStates["index_1"] = []JobState{JobStateRunning, JobStateFailed}
+	config := &CreateBackupConfig{
+		BigtableTableIDPrefix: "index_",
+		DestinationPath:       path,
+		JobRunner:             runner,
+		JobStateCheckInterval: time.Millisecond,
+		TableAdmin:            testTableAdmin(),
+	}
+	err := CreateBackup(config)
+	if err == nil || err.Error() != "Failed to back up 1 of 3 tables" {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	// The tables after the failed one are skipped.
+	if jobs := runner.ExportJobs(); len(jobs) != 1 || jobs[0].BigtableTableID != "index_1" {
+		t.Errorf("Unexpected export jobs %+v", jobs)
+	}
+}
+
+func TestCreateBackupReportToStdout(t *testing.T) {
+	_, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	var err error
+	data := captureStdout(t, func() {
+		err = CreateBackup(&CreateBackupConfig{
+			BigtableTableIDPrefix: "index_",
+			DestinationPath:       path,
+			ReportFile:            "-",
+			JobRunner:             NewFakeJobRunner(),
+			JobStateCheckInterval: time.Millisecond,
+			TableAdmin:            testTableAdmin(),
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stdout only has the report.
+	var report backupReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("Stdout is not a JSON report: %v\n%s", err, data)
+	}
+	if len(report.Tables) != 3 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+}
+
+func TestCreateBackupNoTables(t *testing.T) {
+	_, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	config := &CreateBackupConfig{
+		BigtableTableIDPrefix: "missing_",
+		DestinationPath:       path,
+		JobRunner:             NewFakeJobRunner(),
+		TableAdmin:            testTableAdmin(),
+	}
+	if err := CreateBackup(config); err == nil || err.Error() != "No tables found" {
+		t.Fatalf("Unexpected error %v", err)
+	}
+}
+
+func TestCreateBackupListOnlySkipUnchanged(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	// With hourly tables, index_1 is written to until 7200 and index_2 until 10800.
+	writeTestBackup(t, store, "index_1", 10000, 0, true)
+	writeTestBackup(t, store, "index_2", 10000, 0, true)
+
+	runner := NewFakeJobRunner()
+	var err error
+	data := captureStdout(t, func() {
+		err = CreateBackup(&CreateBackupConfig{
+			BigtableTableIDPrefix: "index_",
+			DestinationPath:       path,
+			PeriodicTables:        PeriodicTableConfig{Period: time.Hour},
+			SkipUnchanged:         true,
+			ListOnly:              true,
+			JobRunner:             runner,
+			TableAdmin:            testTableAdmin(),
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "index_2\nindex_3\n"; string(data) != expected {
+		t.Errorf("Listed %q instead of %q", data, expected)
+	}
+	if jobs := runner.ExportJobs(); len(jobs) != 0 {
+		t.Errorf("Unexpected export jobs %+v", jobs)
+	}
+}
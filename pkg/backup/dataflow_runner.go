@@ -0,0 +1,105 @@
+package backup
+
+import (
+	"context"
+	"errors"
+
+	dataflowV1b3 "google.golang.org/api/dataflow/v1b3"
+)
+
+const (
+	bigtableToGCSSequenceFileTemplatePath = "gs://dataflow-templates/latest/Cloud_Bigtable_to_GCS_SequenceFile"
+	// GCSSequenceFileToBigtableTemplatePath is the path of the Dataflow template used for restoring backups.
+	GCSSequenceFileToBigtableTemplatePath = "gs://dataflow-templates/latest/GCS_SequenceFile_to_Cloud_Bigtable"
+)
+
+// DataflowJobRunner runs the jobs with the Google-provided Dataflow templates.
+type DataflowJobRunner struct {
+	service    *dataflowV1b3.Service
+	projectID  string
+	location   string
+	tempPrefix string
+}
+
+// NewDataflowJobRunner creates a DataflowJobRunner which runs the jobs in the given project and location.
+func NewDataflowJobRunner(ctx context.Context, projectID, location, tempPrefix string) (*DataflowJobRunner, error) {
+	service, err := dataflowV1b3.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DataflowJobRunner{
+		service:    service,
+		projectID:  projectID,
+		location:   location,
+		tempPrefix: tempPrefix,
+	}, nil
+}
+
+// LaunchExport launches the Cloud_Bigtable_to_GCS_SequenceFile template.
+// The template always exports all the cells, so it does not support StartTime.
+func (r *DataflowJobRunner) LaunchExport(ctx context.Context, job *ExportJob) (string, error) {
+	if !job.StartTime.IsZero() {
+		return "", errors.New("Incremental exports are not supported by the dataflow runner, use the local runner")
+	}
+
+	return r.launchTemplate(ctx, job.Name, bigtableToGCSSequenceFileTemplatePath, map[string]string{
+		"bigtableProject":    job.BigtableProjectID,
+		"bigtableInstanceId": job.BigtableInstanceID,
+		"bigtableTableId":    job.BigtableTableID,
+		"destinationPath":    job.DestinationPath,
+		"filenamePrefix":     job.FilenamePrefix,
+	})
+}
+
+// LaunchImport launches the GCS_SequenceFile_to_Cloud_Bigtable template.
+// The template always imports all the rows, so it does not support partial imports.
+func (r *DataflowJobRunner) LaunchImport(ctx context.Context, job *ImportJob) (string, error) {
+	if job.partial() {
+		return "", errors.New("Partial imports are not supported by the dataflow runner, use the local runner")
+	}
+
+	return r.launchTemplate(ctx, job.Name, GCSSequenceFileToBigtableTemplatePath, map[string]string{
+		"bigtableProject":    job.BigtableProjectID,
+		"bigtableInstanceId": job.BigtableInstanceID,
+		"bigtableTableId":    job.BigtableTableID,
+		"sourcePattern":      job.SourcePath + job.FilenamePrefix + "*",
+	})
+}
+
+func (r *DataflowJobRunner) launchTemplate(ctx context.Context, jobName, templatePath string, parameters map[string]string) (string, error) {
+	createJobFromTemplateRequest := dataflowV1b3.CreateJobFromTemplateRequest{
+		JobName:    jobName,
+		GcsPath:    templatePath,
+		Parameters: parameters,
+		Environment: &dataflowV1b3.RuntimeEnvironment{
+			TempLocation: r.tempPrefix,
+		},
+		Location: r.location,
+	}
+
+	job, err := r.service.Projects.Templates.Create(r.projectID, &createJobFromTemplateRequest).Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+
+	return job.Id, nil
+}
+
+// GetJobState gets the current state of the Dataflow job.
+func (r *DataflowJobRunner) GetJobState(ctx context.Context, jobID string) (JobState, error) {
+	job, err := r.service.Projects.Locations.Jobs.Get(r.projectID, r.location, jobID).Context(ctx).Do()
+	if err != nil {
+		return JobStateUnknown, err
+	}
+
+	return JobState(job.CurrentState), nil
+}
+
+// CancelJob requests the cancellation of the Dataflow job.
+func (r *DataflowJobRunner) CancelJob(ctx context.Context, jobID string) error {
+	_, err := r.service.Projects.Locations.Jobs.Update(r.projectID, r.location, jobID, &dataflowV1b3.Job{
+		RequestedState: string(JobStateCancelled),
+	}).Context(ctx).Do()
+	return err
+}
@@ -3,56 +3,170 @@ package backup
 import (
 	"context"
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	storageV1 "google.golang.org/api/storage/v1"
+	"google.golang.org/api/googleapi"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
+const (
+	defaultDeleteParallelism = 16
+	deleteProgressInterval   = 10 * time.Second
+	maxDeleteAttempts        = 5
+)
+
+// deleteRetryBackoff is the time before the first retry of a deletion, which doubles with every retry.
+var deleteRetryBackoff = time.Second
+
 // DeleteBackupConfig has the config to delete the backups.
 type DeleteBackupConfig struct {
 	BigtableTableID string
 	BackupPath      string
 	BackupTimestamp string
+	// Parallelism is the maximum number of objects deleted at once. Defaults to 16.
+	Parallelism int
 }
 
 // RegisterDeleteBackupsFlags registers the flags for DeleteBackup command.
 func RegisterDeleteBackupsFlags(cmd *kingpin.CmdClause) *DeleteBackupConfig {
 	config := DeleteBackupConfig{}
 	cmd.Flag("bigtable-table-id", "ID of the bigtable table to delete its backup").Required().StringVar(&config.BigtableTableID)
-	cmd.Flag("backup-path", "GCS path where backups can be found").Required().StringVar(&config.BackupPath)
+	cmd.Flag("backup-path", "Path where backups can be found. Supports gs:// and file:// paths").Required().StringVar(&config.BackupPath)
 	cmd.Flag("backup-timestamp", "Timestamp of the backup to delete").Required().StringVar(&config.BackupTimestamp)
+	cmd.Flag("parallelism", "Maximum number of objects deleted at once").Default(strconv.Itoa(defaultDeleteParallelism)).IntVar(&config.Parallelism)
 	return &config
 }
 
 // DeleteBackup deletes the backups.
 func DeleteBackup(config *DeleteBackupConfig) error {
+	// The objects of the backup are listed by prefix, which must not match the objects of any other backup.
+	// With file:// paths, "." and ".." would also be resolved to other directories.
+	if config.BigtableTableID == "" || config.BigtableTableID == "." || config.BigtableTableID == ".." || strings.Contains(config.BigtableTableID, "/") {
+		return fmt.Errorf("Invalid table Id %q of the backup to delete", config.BigtableTableID)
+	}
+	timestamp, err := strconv.ParseInt(config.BackupTimestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid timestamp %q of the backup to delete", config.BackupTimestamp)
+	}
+
 	ctx := context.Background()
-	service, err := storageV1.NewService(ctx)
+	store, err := NewBackupStore(ctx, config.BackupPath)
 	if err != nil {
 		return err
 	}
 
-	bucketName, objectPrefix := getBucketNameAndObjectPrefix(config.BackupPath)
-	objectName := objectPrefix + config.BigtableTableID + "/" + config.BackupTimestamp + "/"
+	return deleteBackup(ctx, store, config, timestamp)
+}
 
-	objectListCall := service.Objects.List(bucketName)
-	if objectPrefix != "" {
-		objectListCall.Prefix(objectName)
+// deleteBackup deletes the objects of the backup with the validated config from the store.
+func deleteBackup(ctx context.Context, store BackupStore, config *DeleteBackupConfig, timestamp int64) error {
+	parallelism := config.Parallelism
+	if parallelism < 1 {
+		parallelism = defaultDeleteParallelism
 	}
 
-	objects, err := objectListCall.Do()
+	objects, err := store.ListObjects(ctx, config.BigtableTableID+"/"+config.BackupTimestamp+"/")
 	if err != nil {
 		return err
 	}
 
-	for _, object := range objects.Items {
-		err := service.Objects.Delete(bucketName, object.Name).Do()
-		if err != nil {
-			return err
+	// The manifest is deleted first, so that a partially deleted backup is incomplete instead of missing shards.
+	var deleted, failed int64
+	names := make([]string, 0, len(objects))
+	manifest := manifestName(config.BigtableTableID, timestamp)
+	for _, object := range objects {
+		if object.Name == manifest {
+			if err := deleteObjectWithRetries(ctx, store, object.Name); err != nil {
+				return fmt.Errorf("Error deleting manifest of backup for table %s with timestamp %s with error: %s", config.BigtableTableID, config.BackupTimestamp, err)
+			}
+			deleted++
+			continue
 		}
+		names = append(names, object.Name)
 	}
 
-	fmt.Printf("Backup deleted for table %s with timestamp %s\n", config.BigtableTableID, config.BackupTimestamp)
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(deleteProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fmt.Printf("Deleted %d of %d objects of backup for table %s with timestamp %s\n",
+					atomic.LoadInt64(&deleted), len(objects), config.BigtableTableID, config.BackupTimestamp)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	queue := make(chan string)
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range queue {
+				if err := deleteObjectWithRetries(ctx, store, name); err != nil {
+					atomic.AddInt64(&failed, 1)
+					fmt.Printf("Error deleting %s with error: %s\n", name, err)
+					continue
+				}
+				atomic.AddInt64(&deleted, 1)
+			}
+		}()
+	}
+	for _, name := range names {
+		queue <- name
+	}
+	close(queue)
+	wg.Wait()
+	close(done)
+
+	if failed > 0 {
+		return fmt.Errorf("Failed to delete %d of %d objects of backup for table %s with timestamp %s, %d objects deleted",
+			failed, len(objects), config.BigtableTableID, config.BackupTimestamp, deleted)
+	}
+
+	fmt.Printf("Backup deleted for table %s with timestamp %s, %d objects deleted\n", config.BigtableTableID, config.BackupTimestamp, deleted)
 
 	return nil
 }
+
+// deleteObjectWithRetries deletes an object, retrying with exponential backoff on transient errors.
+// Objects which no longer exist are considered deleted, since a failed attempt may have deleted them.
+func deleteObjectWithRetries(ctx context.Context, store BackupStore, name string) error {
+	backoff := deleteRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := store.DeleteObject(ctx, name)
+		if err == nil || isNotExist(err) {
+			return nil
+		}
+		if attempt == maxDeleteAttempts || !isTransient(err) {
+			return err
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// isTransient returns whether the error of a request to a BackupStore may not happen again if the request is retried.
+func isTransient(err error) bool {
+	if apiErr, ok := err.(*googleapi.Error); ok {
+		return apiErr.Code == http.StatusTooManyRequests || apiErr.Code == http.StatusRequestTimeout || apiErr.Code >= http.StatusInternalServerError
+	}
+	// The requests which failed before getting a response, like the ones whose connection was reset.
+	if _, ok := err.(*url.Error); ok {
+		return true
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
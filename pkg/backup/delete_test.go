@@ -0,0 +1,223 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestDeleteBackup(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	writeTestBackup(t, store, "index_1", 100, 0, true)
+	writeTestBackup(t, store, "index_1", 1000, 0, true)
+	writeTestBackup(t, store, "index_10", 100, 0, true)
+	for i := 0; i < 50; i++ {
+		writeTestObject(t, store, fmt.Sprintf("index_1/100/index_1:%d", i+1))
+	}
+
+	err := DeleteBackup(&DeleteBackupConfig{BigtableTableID: "index_1", BackupPath: path, BackupTimestamp: "100", Parallelism: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if objects, err := store.ListObjects(ctx, "index_1/100/"); err != nil || len(objects) != 0 {
+		t.Errorf("Expected the backup to be deleted, got %v, %v", objects, err)
+	}
+	// The backups with a timestamp or table ID starting like the ones of the deleted backup are kept.
+	for _, prefix := range []string{"index_1/1000/", "index_10/100/"} {
+		if objects, err := store.ListObjects(ctx, prefix); err != nil || len(objects) != 2 {
+			t.Errorf("Expected the objects of %s to be kept, got %v, %v", prefix, objects, err)
+		}
+	}
+}
+
+func TestDeleteBackupInvalid(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	writeTestBackup(t, store, "index_1", 100, 0, true)
+	writeTestBackup(t, store, "index_2", 100, 0, true)
+
+	for _, config := range []DeleteBackupConfig{
+		{BigtableTableID: "", BackupPath: path, BackupTimestamp: "100"},
+		{BigtableTableID: "index_1/100", BackupPath: path, BackupTimestamp: "100"},
+		{BigtableTableID: "index_1", BackupPath: path, BackupTimestamp: ""},
+		{BigtableTableID: "index_1", BackupPath: path, BackupTimestamp: "100/"},
+		// With file:// paths, the prefix ../100/ of the backup path index_1/other is the backup index_1/100.
+		{BigtableTableID: "..", BackupPath: path + "/index_1/other", BackupTimestamp: "100"},
+		{BigtableTableID: ".", BackupPath: path + "/index_1", BackupTimestamp: "100"},
+	} {
+		config := config
+		if err := DeleteBackup(&config); err == nil {
+			t.Errorf("Expected an error deleting the backup with %+v", config)
+		}
+	}
+
+	for _, prefix := range []string{"index_1/100/", "index_2/100/"} {
+		if objects, err := store.ListObjects(context.Background(), prefix); err != nil || len(objects) != 2 {
+			t.Errorf("Expected the objects of %s to be kept, got %v, %v", prefix, objects, err)
+		}
+	}
+}
+
+// failingStore fails the deletions of some objects with the given errors, one per attempt, before deleting them.
+type failingStore struct {
+	BackupStore
+
+	mtx      sync.Mutex
+	errs     map[string][]error
+	attempts map[string]int
+}
+
+func (s *failingStore) DeleteObject(ctx context.Context, name string) error {
+	s.mtx.Lock()
+	s.attempts[name]++
+	errs := s.errs[name]
+	if len(errs) > 0 {
+		s.errs[name] = errs[1:]
+	}
+	s.mtx.Unlock()
+
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return s.BackupStore.DeleteObject(ctx, name)
+}
+
+func repeatErr(err error, n int) []error {
+	errs := make([]error, n)
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
+
+func TestDeleteBackupRetries(t *testing.T) {
+	backoff := deleteRetryBackoff
+	deleteRetryBackoff = time.Millisecond
+	defer func() { deleteRetryBackoff = backoff }()
+
+	store, _, cleanup := newTestStore(t)
+	defer cleanup()
+
+	writeTestBackup(t, store, "index_1", 100, 0, true)
+	for i := 1; i <= 5; i++ {
+		writeTestObject(t, store, fmt.Sprintf("index_1/100/index_1:-%05d", i))
+	}
+
+	unavailable := &googleapi.Error{Code: http.StatusServiceUnavailable}
+	connectionReset := &url.Error{Op: "Delete", URL: "https://storage.googleapis.com", Err: syscall.ECONNRESET}
+	failing := &failingStore{
+		BackupStore: store,
+		errs: map[string][]error{
+			"index_1/100/index_1:-00001": {unavailable, connectionReset},
+			"index_1/100/index_1:-00002": {&googleapi.Error{Code: http.StatusForbidden}},
+			"index_1/100/index_1:-00003": repeatErr(unavailable, maxDeleteAttempts),
+			"index_1/100/index_1:-00004": {&googleapi.Error{Code: http.StatusNotFound}},
+		},
+		attempts: map[string]int{},
+	}
+
+	var err error
+	output := captureStdout(t, func() {
+		err = deleteBackup(context.Background(), failing, &DeleteBackupConfig{BigtableTableID: "index_1", BackupTimestamp: "100"}, 100)
+	})
+	expected := "Failed to delete 2 of 7 objects of backup for table index_1 with timestamp 100, 5 objects deleted"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("Expected error %q, got %v", expected, err)
+	}
+	for _, name := range []string{"index_1/100/index_1:-00002", "index_1/100/index_1:-00003"} {
+		if !strings.Contains(string(output), "Error deleting "+name) {
+			t.Errorf("Expected the failure to delete %s in the output:\n%s", name, output)
+		}
+	}
+
+	for name, expected := range map[string]int{
+		manifestName("index_1", 100): 1,
+		"index_1/100/index_1:0":      1,
+		"index_1/100/index_1:-00001": 3,
+		"index_1/100/index_1:-00002": 1,
+		"index_1/100/index_1:-00003": maxDeleteAttempts,
+		"index_1/100/index_1:-00004": 1,
+		"index_1/100/index_1:-00005": 1,
+	} {
+		if failing.attempts[name] != expected {
+			t.Errorf("Deleted %s in %d attempts instead of %d", name, failing.attempts[name], expected)
+		}
+	}
+
+	// The objects which failed to be deleted are left, the backup is incomplete without its manifest.
+	var names []string
+	objects, err := store.ListObjects(context.Background(), "index_1/100/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, object := range objects {
+		names = append(names, object.Name)
+	}
+	sort.Strings(names)
+	if expected := []string{"index_1/100/index_1:-00002", "index_1/100/index_1:-00003", "index_1/100/index_1:-00004"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Objects %v left instead of %v", names, expected)
+	}
+}
+
+func TestDeleteBackupManifestFailure(t *testing.T) {
+	store, _, cleanup := newTestStore(t)
+	defer cleanup()
+
+	writeTestBackup(t, store, "index_1", 100, 0, true)
+	failing := &failingStore{
+		BackupStore: store,
+		errs:        map[string][]error{manifestName("index_1", 100): {&googleapi.Error{Code: http.StatusForbidden}}},
+		attempts:    map[string]int{},
+	}
+
+	err := deleteBackup(context.Background(), failing, &DeleteBackupConfig{BigtableTableID: "index_1", BackupTimestamp: "100"}, 100)
+	if err == nil || !strings.HasPrefix(err.Error(), "Error deleting manifest of backup for table index_1 with timestamp 100") {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	// The shards of a backup are only deleted once it is incomplete.
+	if objects, err := store.ListObjects(context.Background(), "index_1/100/"); err != nil || len(objects) != 2 {
+		t.Errorf("Expected the backup to be kept, got %v, %v", objects, err)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	for _, tc := range []struct {
+		err      error
+		expected bool
+	}{
+		{err: &googleapi.Error{Code: http.StatusTooManyRequests}, expected: true},
+		{err: &googleapi.Error{Code: http.StatusRequestTimeout}, expected: true},
+		{err: &googleapi.Error{Code: http.StatusInternalServerError}, expected: true},
+		{err: &googleapi.Error{Code: http.StatusServiceUnavailable}, expected: true},
+		{err: &googleapi.Error{Code: http.StatusForbidden}},
+		{err: &googleapi.Error{Code: http.StatusNotFound}},
+		{err: &url.Error{Op: "Delete", URL: "https://storage.googleapis.com", Err: syscall.ECONNRESET}, expected: true},
+		{err: &url.Error{Op: "Delete", URL: "https://storage.googleapis.com", Err: &net.DNSError{IsTimeout: true}}, expected: true},
+		{err: &net.DNSError{IsTimeout: true}, expected: true},
+		{err: &net.DNSError{}},
+		{err: &os.PathError{Op: "remove", Path: "/backups/index_1", Err: syscall.EACCES}},
+		{err: errors.New("error")},
+	} {
+		if actual := isTransient(tc.err); actual != tc.expected {
+			t.Errorf("Error %v is transient: %v instead of %v", tc.err, actual, tc.expected)
+		}
+	}
+}
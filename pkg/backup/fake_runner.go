@@ -0,0 +1,129 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// FakeJobRunner is a JobRunner which runs nothing. The jobs only go through
+// the configured states, which allows exercising the creation and restoration
+// of backups without GCP.
+type FakeJobRunner struct {
+	// JobStates has the states that the jobs of a table go through, keyed by
+	// the table ID. Every GetJobState call moves the job to the next state and
+	// the last state is kept once reached. Jobs of other tables are reported as
+	// running on the first call and done afterwards.
+	JobStates map[string][]JobState
+
+	mtx        sync.Mutex
+	exportJobs []ExportJob
+	importJobs []ImportJob
+	jobs       map[string]*fakeJob
+}
+
+type fakeJob struct {
+	tableID   string
+	polls     int
+	cancelled bool
+}
+
+// NewFakeJobRunner creates a FakeJobRunner.
+func NewFakeJobRunner() *FakeJobRunner {
+	return &FakeJobRunner{
+		JobStates: map[string][]JobState{},
+		jobs:      map[string]*fakeJob{},
+	}
+}
+
+// LaunchExport records the export job.
+func (r *FakeJobRunner) LaunchExport(ctx context.Context, job *ExportJob) (string, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.exportJobs = append(r.exportJobs, *job)
+	return r.addJob(job.BigtableTableID), nil
+}
+
+// LaunchImport records the import job.
+func (r *FakeJobRunner) LaunchImport(ctx context.Context, job *ImportJob) (string, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.importJobs = append(r.importJobs, *job)
+	return r.addJob(job.BigtableTableID), nil
+}
+
+func (r *FakeJobRunner) addJob(tableID string) string {
+	jobID := fmt.Sprintf("fake-job-%d", len(r.jobs))
+	r.jobs[jobID] = &fakeJob{tableID: tableID}
+	return jobID
+}
+
+// GetJobState moves the job to its next state and returns it.
+func (r *FakeJobRunner) GetJobState(ctx context.Context, jobID string) (JobState, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	job, ok := r.jobs[jobID]
+	if !ok {
+		return JobStateUnknown, fmt.Errorf("Job with Id %s not found", jobID)
+	}
+	if job.cancelled {
+		return JobStateCancelled, nil
+	}
+
+	states, ok := r.JobStates[job.tableID]
+	if !ok || len(states) == 0 {
+		states = []JobState{JobStateRunning, JobStateDone}
+	}
+
+	state := states[len(states)-1]
+	if job.polls < len(states) {
+		state = states[job.polls]
+	}
+	job.polls++
+
+	return state, nil
+}
+
+// CancelJob marks the job as cancelled.
+func (r *FakeJobRunner) CancelJob(ctx context.Context, jobID string) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	job, ok := r.jobs[jobID]
+	if !ok {
+		return fmt.Errorf("Job with Id %s not found", jobID)
+	}
+	job.cancelled = true
+
+	return nil
+}
+
+// Polls returns the number of GetJobState calls of the job.
+func (r *FakeJobRunner) Polls(jobID string) int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if job, ok := r.jobs[jobID]; ok {
+		return job.polls
+	}
+	return 0
+}
+
+// ExportJobs returns the export jobs launched so far.
+func (r *FakeJobRunner) ExportJobs() []ExportJob {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	return append([]ExportJob(nil), r.exportJobs...)
+}
+
+// ImportJobs returns the import jobs launched so far.
+func (r *FakeJobRunner) ImportJobs() []ImportJob {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	return append([]ImportJob(nil), r.importJobs...)
+}
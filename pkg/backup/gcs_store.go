@@ -0,0 +1,150 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	storageV1 "google.golang.org/api/storage/v1"
+)
+
+var errWriterAborted = errors.New("Writer aborted")
+
+type gcsStore struct {
+	service      *storageV1.Service
+	bucketName   string
+	objectPrefix string
+}
+
+func newGCSStore(ctx context.Context, path string) (*gcsStore, error) {
+	service, err := storageV1.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	bucketName, objectPrefix := getBucketNameAndObjectPrefix(path)
+	return &gcsStore{
+		service:      service,
+		bucketName:   bucketName,
+		objectPrefix: objectPrefix,
+	}, nil
+}
+
+func (s *gcsStore) ListObjects(ctx context.Context, prefix string) ([]ObjectAttrs, error) {
+	objectListCall := s.service.Objects.List(s.bucketName).Context(ctx)
+	if s.objectPrefix+prefix != "" {
+		objectListCall.Prefix(s.objectPrefix + prefix)
+	}
+
+	var objects []ObjectAttrs
+	err := objectListCall.Pages(ctx, func(page *storageV1.Objects) error {
+		for _, object := range page.Items {
+			objects = append(objects, ObjectAttrs{
+				Name:   object.Name[len(s.objectPrefix):],
+				Size:   int64(object.Size),
+				CRC32C: object.Crc32c,
+				MD5:    object.Md5Hash,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return objects, nil
+}
+
+func (s *gcsStore) ListPrefixes(ctx context.Context, prefix string) ([]string, error) {
+	objectListCall := s.service.Objects.List(s.bucketName).Context(ctx).Delimiter("/")
+	if s.objectPrefix+prefix != "" {
+		objectListCall.Prefix(s.objectPrefix + prefix)
+	}
+
+	var prefixes []string
+	err := objectListCall.Pages(ctx, func(page *storageV1.Objects) error {
+		for _, p := range page.Prefixes {
+			prefixes = append(prefixes, strings.TrimSuffix(p[len(s.objectPrefix)+len(prefix):], "/"))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return prefixes, nil
+}
+
+func (s *gcsStore) NewReader(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := s.service.Objects.Get(s.bucketName, s.objectPrefix+name).Context(ctx).Download()
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+func (s *gcsStore) NewWriter(ctx context.Context, name string) (ObjectWriter, error) {
+	pr, pw := io.Pipe()
+	w := &gcsWriter{pw: pw, done: make(chan struct{})}
+
+	go func() {
+		defer close(w.done)
+		_, w.err = s.service.Objects.Insert(s.bucketName, &storageV1.Object{Name: s.objectPrefix + name}).Media(pr).Context(ctx).Do()
+		// Unblock any pending writes if the upload failed.
+		pr.CloseWithError(w.err)
+	}()
+
+	return w, nil
+}
+
+func (s *gcsStore) DeleteObject(ctx context.Context, name string) error {
+	return s.service.Objects.Delete(s.bucketName, s.objectPrefix+name).Context(ctx).Do()
+}
+
+func (s *gcsStore) URL(name string) string {
+	return gcsScheme + s.bucketName + "/" + s.objectPrefix + name
+}
+
+// gcsWriter streams the written data to an upload running in the background.
+type gcsWriter struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+	err  error
+}
+
+func (w *gcsWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *gcsWriter) Close() error {
+	if err := w.pw.Close(); err != nil {
+		return err
+	}
+	<-w.done
+	return w.err
+}
+
+// Abort fails the upload, so the object is not created.
+func (w *gcsWriter) Abort() {
+	w.pw.CloseWithError(errWriterAborted)
+	<-w.done
+}
+
+func getBucketNameAndObjectPrefix(backupPath string) (bucketName, objectPrefix string) {
+	if strings.HasPrefix(backupPath, gcsScheme) {
+		backupPath = backupPath[len(gcsScheme):]
+	}
+	ss := strings.SplitN(backupPath, "/", 2)
+	bucketName = ss[0]
+
+	if len(ss) == 2 && ss[1] != "" {
+		objectPrefix = ss[1]
+		if !strings.HasSuffix(objectPrefix, "/") {
+			objectPrefix = objectPrefix + "/"
+		}
+	}
+
+	return
+}
@@ -0,0 +1,138 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/grafana/bigtable-backup/pkg/seqfile"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// errLimitReached stops reading the shards once enough rows have been printed.
+var errLimitReached = errors.New("limit reached")
+
+// InspectBackupConfig has the config for InspectBackup command.
+type InspectBackupConfig struct {
+	BackupPath      string
+	BigtableTableID string
+	BackupTimestamp int64
+	RowPrefix       string
+	Limit           int
+	OutputFormat    string
+	ValueEncoding   string
+}
+
+// RegisterInspectBackupFlags registers the flags for InspectBackup command.
+func RegisterInspectBackupFlags(cmd *kingpin.CmdClause) *InspectBackupConfig {
+	config := InspectBackupConfig{}
+	cmd.Flag("backup-path", "Path where backups can be found. Supports gs:// and file:// paths").Required().StringVar(&config.BackupPath)
+	cmd.Flag("bigtable-table-id", "ID of the bigtable table of the backup").Required().StringVar(&config.BigtableTableID)
+	cmd.Flag("backup-timestamp", "Timestamp of the backup to inspect. If not set, most recent backup would be inspected").Int64Var(&config.BackupTimestamp)
+	cmd.Flag("row-prefix", "Only print the rows with keys starting with this prefix").StringVar(&config.RowPrefix)
+	cmd.Flag("limit", "Maximum number of rows to print. 0 prints all the rows").IntVar(&config.Limit)
+	cmd.Flag("output", "Output Format. Support json, text. Defaults to text").Short('o').Default("text").EnumVar(&config.OutputFormat, "text", "json")
+	cmd.Flag("value-encoding", "Encoding of the cell values, and of the row keys and qualifiers of the json output. Either hex or base64").Default("hex").EnumVar(&config.ValueEncoding, "hex", "base64")
+	return &config
+}
+
+// inspectedCell is a cell as printed by InspectBackup.
+type inspectedCell struct {
+	// RowKey and Qualifier are not valid UTF-8 when they are binary, which JSON cannot represent,
+	// so RowKeyBytes and QualifierBytes have them encoded like the value.
+	RowKey         string `json:"row_key"`
+	RowKeyBytes    string `json:"row_key_bytes"`
+	Family         string `json:"family"`
+	Qualifier      string `json:"qualifier"`
+	QualifierBytes string `json:"qualifier_bytes"`
+	// Timestamp in microseconds, like Bigtable timestamps.
+	Timestamp int64  `json:"timestamp"`
+	Value     string `json:"value"`
+}
+
+// InspectBackup prints the cells of the rows in a backup, one cell per line.
+func InspectBackup(config *InspectBackupConfig) error {
+	if config.BackupTimestamp == 0 {
+		backupTimestamp, err := getNewestBackupTimestamp(config.BackupPath, config.BigtableTableID, time.Time{})
+		if err != nil {
+			return err
+		}
+		config.BackupTimestamp = *backupTimestamp
+	}
+
+	ctx := context.Background()
+	store, err := NewBackupStore(ctx, config.BackupPath)
+	if err != nil {
+		return err
+	}
+
+	prefix := fmt.Sprintf("%s/%d/%s%s", config.BigtableTableID, config.BackupTimestamp, config.BigtableTableID, bigtableIDSeparatorInSeqFileName)
+	objects, err := store.ListObjects(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		return fmt.Errorf("No backup found for table %s with timestamp %d", config.BigtableTableID, config.BackupTimestamp)
+	}
+
+	encodeValue := hex.EncodeToString
+	if config.ValueEncoding == "base64" {
+		encodeValue = base64.StdEncoding.EncodeToString
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	encoder := json.NewEncoder(out)
+
+	rowPrefix := []byte(config.RowPrefix)
+	rows := 0
+	for _, object := range objects {
+		err := forEachRow(ctx, store, object.Name, func(rowKey []byte, cells []seqfile.Cell) error {
+			if !bytes.HasPrefix(rowKey, rowPrefix) {
+				return nil
+			}
+			if config.Limit > 0 && rows >= config.Limit {
+				return errLimitReached
+			}
+			rows++
+
+			for _, cell := range cells {
+				c := inspectedCell{
+					RowKey:         string(rowKey),
+					RowKeyBytes:    encodeValue(rowKey),
+					Family:         string(cell.Family),
+					Qualifier:      string(cell.Qualifier),
+					QualifierBytes: encodeValue(cell.Qualifier),
+					Timestamp:      cell.Timestamp * 1000,
+					Value:          encodeValue(cell.Value),
+				}
+
+				if config.OutputFormat == "json" {
+					if err := encoder.Encode(c); err != nil {
+						return err
+					}
+					continue
+				}
+				if _, err := fmt.Fprintf(out, "%q\t%s:%q\t%d\t%s\n", c.RowKey, c.Family, c.Qualifier, c.Timestamp, c.Value); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err == errLimitReached {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading %s with error: %s", object.Name, err)
+		}
+	}
+
+	return out.Flush()
+}
@@ -0,0 +1,129 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigtable"
+)
+
+func writeTestInspectBackup(t *testing.T, store BackupStore) {
+	w := &shardWriter{ctx: context.Background(), store: store, filenamePrefix: "index_1/100/index_1:", shardSize: defaultShardSize}
+	for _, row := range []bigtable.Row{
+		{"f": {{Row: "\xff\x00bin", Column: "f:\xfe", Timestamp: ms(1000), Value: []byte{1}}}},
+		{
+			"f": {{Row: "user1:a", Column: "f:x", Timestamp: ms(2000), Value: []byte("v1")}},
+			"g": {{Row: "user1:a", Column: "g:y", Timestamp: ms(3000), Value: []byte("v2")}},
+		},
+		{"f": {{Row: "user1:b", Column: "f:x", Timestamp: ms(2000), Value: []byte("v3")}}},
+		{"f": {{Row: "user2:a", Column: "f:x", Timestamp: ms(2000), Value: []byte("v4")}}},
+	} {
+		if err := w.append(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInspectBackupJSON(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+	writeTestInspectBackup(t, store)
+
+	for _, tc := range []struct {
+		encoding string
+		expected []inspectedCell
+	}{
+		{
+			encoding: "hex",
+			expected: []inspectedCell{
+				{RowKey: "\ufffd\x00bin", RowKeyBytes: "ff0062696e", Family: "f", Qualifier: "\ufffd", QualifierBytes: "fe", Timestamp: 1000000, Value: "01"},
+				{RowKey: "user1:a", RowKeyBytes: "75736572313a61", Family: "f", Qualifier: "x", QualifierBytes: "78", Timestamp: 2000000, Value: "7631"},
+			},
+		},
+		{
+			encoding: "base64",
+			expected: []inspectedCell{
+				{RowKey: "\ufffd\x00bin", RowKeyBytes: "/wBiaW4=", Family: "f", Qualifier: "\ufffd", QualifierBytes: "/g==", Timestamp: 1000000, Value: "AQ=="},
+				{RowKey: "user1:a", RowKeyBytes: "dXNlcjE6YQ==", Family: "f", Qualifier: "x", QualifierBytes: "eA==", Timestamp: 2000000, Value: "djE="},
+			},
+		},
+	} {
+		t.Run(tc.encoding, func(t *testing.T) {
+			var err error
+			output := captureStdout(t, func() {
+				err = InspectBackup(&InspectBackupConfig{
+					BackupPath:      path,
+					BigtableTableID: "index_1",
+					BackupTimestamp: 100,
+					Limit:           2,
+					OutputFormat:    "json",
+					ValueEncoding:   tc.encoding,
+				})
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var cells []inspectedCell
+			decoder := json.NewDecoder(bytes.NewReader(output))
+			for decoder.More() {
+				var cell inspectedCell
+				if err := decoder.Decode(&cell); err != nil {
+					t.Fatal(err)
+				}
+				cells = append(cells, cell)
+			}
+			// The limit is a number of rows, which can have several cells.
+			if len(cells) != 3 || !reflect.DeepEqual(cells[:2], tc.expected) || cells[2].Family != "g" {
+				t.Errorf("Printed cells %+v instead of %+v", cells, tc.expected)
+			}
+		})
+	}
+}
+
+func TestInspectBackupText(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+	writeTestInspectBackup(t, store)
+
+	var err error
+	output := captureStdout(t, func() {
+		err = InspectBackup(&InspectBackupConfig{
+			BackupPath:      path,
+			BigtableTableID: "index_1",
+			BackupTimestamp: 100,
+			RowPrefix:       "user1:",
+			OutputFormat:    "text",
+			ValueEncoding:   "hex",
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := strings.Join([]string{
+		`"user1:a"` + "\t" + `f:"x"` + "\t2000000\t7631",
+		`"user1:a"` + "\t" + `g:"y"` + "\t3000000\t7632",
+		`"user1:b"` + "\t" + `f:"x"` + "\t2000000\t7633",
+	}, "\n") + "\n"
+	if string(output) != expected {
+		t.Errorf("Printed:\n%s\ninstead of:\n%s", output, expected)
+	}
+}
+
+func TestInspectBackupNotFound(t *testing.T) {
+	_, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	err := InspectBackup(&InspectBackupConfig{BackupPath: path, BigtableTableID: "index_1", BackupTimestamp: 100})
+	if err == nil || err.Error() != "No backup found for table index_1 with timestamp 100" {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
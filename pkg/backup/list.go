@@ -3,15 +3,18 @@ package backup
 import (
 	"context"
 	"errors"
+	"fmt"
+	"os"
 	"regexp"
 	"sort"
 	"strconv"
-	"strings"
+	"time"
 
-	storageV1 "google.golang.org/api/storage/v1"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
+var numbersOnlyRegex = regexp.MustCompile("^[0-9]+$")
+
 // ListBackupConfig has the config for ListBackup command.
 type ListBackupConfig struct {
 	BackupPath   string
@@ -21,115 +24,179 @@ type ListBackupConfig struct {
 // RegisterListBackupsFlags registers the flags for list backups.
 func RegisterListBackupsFlags(cmd *kingpin.CmdClause) *ListBackupConfig {
 	config := ListBackupConfig{}
-	cmd.Flag("backup-path", "GCS path where backups can be found").Required().StringVar(&config.BackupPath)
-	cmd.Flag("output", "Output Format. Support json, text. Defaults to text").Short('o').StringVar(&config.OutputFormat)
+	cmd.Flag("backup-path", "Path where backups can be found. Supports gs:// and file:// paths").Required().StringVar(&config.BackupPath)
+	cmd.Flag("output", "Output Format. Support json, json-manifests, text. Defaults to text").Short('o').StringVar(&config.OutputFormat)
 	return &config
 }
 
+// Backup is a backup of a table.
+type Backup struct {
+	Timestamp int64 `json:"timestamp"`
+	// Manifest is nil for incomplete backups.
+	Manifest *Manifest `json:"manifest,omitempty"`
+}
+
+// Complete returns whether all the SequenceFiles of the backup have been written,
+// which is when the manifest of the backup has been written.
+func (b Backup) Complete() bool {
+	return b.Manifest != nil
+}
+
 // ListBackups lists the available backups. It returns a map from the tableID
-// to the backup timestamps for that table.
-func ListBackups(config *ListBackupConfig) (map[string][]int64, error) {
+// to the backups for that table, sorted by timestamp.
+func ListBackups(config *ListBackupConfig) (map[string][]Backup, error) {
 	ctx := context.Background()
-	service, err := storageV1.NewService(ctx)
+	store, err := NewBackupStore(ctx, config.BackupPath)
 	if err != nil {
 		return nil, err
 	}
 
-	bucketName, objectPrefix := getBucketNameAndObjectPrefix(config.BackupPath)
+	tableIDs, err := store.ListPrefixes(ctx, "")
+	if err != nil {
+		return nil, err
+	}
 
-	objectListCall := service.Objects.List(bucketName)
-	if objectPrefix != "" {
-		objectListCall.Prefix(objectPrefix)
+	backupsList := make(map[string][]Backup, len(tableIDs))
+	for _, tableID := range tableIDs {
+		backups, err := listTableBackups(ctx, store, tableID)
+		if err != nil {
+			return nil, err
+		}
+		if len(backups) > 0 {
+			backupsList[tableID] = backups
+		}
 	}
 
-	numbersOnlyRegex := regexp.MustCompile("^[0-9]*$")
+	return backupsList, nil
+}
 
-	// tableID --> timestamp.
-	backupTimestampsMap := make(map[string]map[int64]struct{})
+// listTableBackups lists the backups of a table with their manifests, sorted by timestamp.
+func listTableBackups(ctx context.Context, store BackupStore, tableID string) ([]Backup, error) {
+	timestamps, err := listBackupTimestamps(ctx, store, tableID)
+	if err != nil {
+		return nil, err
+	}
 
-	for {
-		objects, err := objectListCall.Do()
+	backups := make([]Backup, 0, len(timestamps))
+	for _, timestamp := range timestamps {
+		manifest, err := readManifest(ctx, store, tableID, timestamp)
 		if err != nil {
 			return nil, err
 		}
+		backups = append(backups, Backup{Timestamp: timestamp, Manifest: manifest})
+	}
+
+	return backups, nil
+}
 
-		for _, object := range objects.Items {
-			ss := strings.SplitN(object.Name[len(objectPrefix):], "/", 3)
-			if len(ss) < 3 || ss[2] == "" {
-				continue
-			}
-			tableID := ss[0]
-			backupTimestamp := ss[1]
-			if !numbersOnlyRegex.Match([]byte(backupTimestamp)) {
-				continue
-			}
-
-			backupTimestampInt64, err := strconv.ParseInt(ss[1], 10, 64)
-			if err != nil {
-				return nil, err
-			}
-
-			if _, isOk := backupTimestampsMap[tableID]; !isOk {
-				backupTimestampsMap[tableID] = map[int64]struct{}{backupTimestampInt64: {}}
-			} else {
-				backupTimestampsMap[tableID][backupTimestampInt64] = struct{}{}
-			}
+// listBackupTimestamps lists the timestamps of the backups of a table, complete or not, in increasing order.
+func listBackupTimestamps(ctx context.Context, store BackupStore, tableID string) ([]int64, error) {
+	backupTimestamps, err := store.ListPrefixes(ctx, tableID+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	timestamps := make([]int64, 0, len(backupTimestamps))
+	for _, backupTimestamp := range backupTimestamps {
+		if !numbersOnlyRegex.MatchString(backupTimestamp) {
+			continue
 		}
 
-		if objects.NextPageToken == "" {
-			break
+		backupTimestampInt64, err := strconv.ParseInt(backupTimestamp, 10, 64)
+		if err != nil {
+			return nil, err
 		}
+		timestamps = append(timestamps, backupTimestampInt64)
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i] < timestamps[j]
+	})
+
+	return timestamps, nil
+}
 
-		objectListCall.PageToken(objects.NextPageToken)
+// newestCompleteBackup returns the newest complete backup of a table made at or before asOf, or nil if there is none.
+// A zero asOf means the newest complete backup. Only the manifests of the backups newer than it are read.
+func newestCompleteBackup(ctx context.Context, store BackupStore, tableID string, asOf time.Time) (*Backup, error) {
+	timestamps, err := listBackupTimestamps(ctx, store, tableID)
+	if err != nil {
+		return nil, err
 	}
 
-	backupTimestampsList := make(map[string][]int64, len(backupTimestampsMap))
-	for tableID, backupTimestamps := range backupTimestampsMap {
-		timestamps := make([]int64, 0, len(backupTimestamps))
-		for backupTimestamp := range backupTimestamps {
-			timestamps = append(timestamps, backupTimestamp)
+	// Incomplete backups are either still being written or failed.
+	for i := len(timestamps) - 1; i >= 0; i-- {
+		if !asOf.IsZero() && timestamps[i] > asOf.Unix() {
+			continue
+		}
+		manifest, err := readManifest(ctx, store, tableID, timestamps[i])
+		if err != nil {
+			return nil, err
+		}
+		if manifest != nil {
+			return &Backup{Timestamp: timestamps[i], Manifest: manifest}, nil
 		}
-
-		sort.Slice(timestamps, func(i, j int) bool {
-			return timestamps[i] < timestamps[j]
-		})
-		backupTimestampsList[tableID] = timestamps
 	}
 
-	return backupTimestampsList, nil
+	return nil, nil
 }
 
-func getBucketNameAndObjectPrefix(backupPath string) (bucketName, objectPrefix string) {
-	if strings.HasPrefix(backupPath, "gs://") {
-		backupPath = backupPath[5:]
+// newestLegacyBackup returns the timestamp of the newest backup of a table made at or before asOf
+// when none of the backups of the table has a manifest, as in the buckets written before manifests.
+// It returns nil if a backup of the table has a manifest or if there is no backup at or before asOf.
+func newestLegacyBackup(ctx context.Context, store BackupStore, tableID string, asOf time.Time) (*int64, error) {
+	timestamps, err := listBackupTimestamps(ctx, store, tableID)
+	if err != nil {
+		return nil, err
 	}
-	ss := strings.SplitN(backupPath, "/", 2)
-	bucketName = ss[0]
 
-	if len(ss) == 2 {
-		objectPrefix = ss[1]
-		if !strings.HasSuffix(objectPrefix, "/") {
-			objectPrefix = objectPrefix + "/"
+	var newest *int64
+	for i := range timestamps {
+		manifest, err := readManifest(ctx, store, tableID, timestamps[i])
+		if err != nil {
+			return nil, err
+		}
+		if manifest != nil {
+			return nil, nil
+		}
+		if asOf.IsZero() || timestamps[i] <= asOf.Unix() {
+			newest = &timestamps[i]
 		}
 	}
 
-	return
+	return newest, nil
 }
 
-func getNewestBackupTimestamp(backupPath string, tableID string) (*int64, error) {
-	backups, err := ListBackups(&ListBackupConfig{BackupPath: backupPath})
+// getNewestBackupTimestamp returns the timestamp of the newest complete backup of a table
+// made at or before asOf. A zero asOf means the newest complete backup.
+// If none of the backups of the table has a manifest, it falls back to the newest backup, with a warning.
+func getNewestBackupTimestamp(backupPath string, tableID string, asOf time.Time) (*int64, error) {
+	ctx := context.Background()
+	store, err := NewBackupStore(ctx, backupPath)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(backups) == 0 {
-		return nil, errors.New("No backups found")
+	backup, err := newestCompleteBackup(ctx, store, tableID, asOf)
+	if err != nil {
+		return nil, err
+	}
+	if backup != nil {
+		return &backup.Timestamp, nil
 	}
 
-	backupTimestamps := backups[tableID]
-	if len(backupTimestamps) == 0 {
-		return nil, errors.New("No backups found")
+	legacy, err := newestLegacyBackup(ctx, store, tableID, asOf)
+	if err != nil {
+		return nil, err
+	}
+	if legacy != nil {
+		fmt.Fprintf(os.Stderr, "Warning: no backup of table %s has a manifest, using the newest backup %d although it may be incomplete. "+
+			"Run backfill-manifest on the backups whose jobs succeeded to stop relying on this fallback\n", tableID, *legacy)
+		return legacy, nil
 	}
 
-	return &backupTimestamps[len(backupTimestamps)-1], nil
+	if !asOf.IsZero() {
+		return nil, fmt.Errorf("No complete backups found at or before %s", asOf.Format(time.RFC3339))
+	}
+	return nil, errors.New("No complete backups found")
 }
@@ -0,0 +1,124 @@
+package backup
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestListBackups(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	writeTestBackup(t, store, "index_1", 200, 0, true)
+	writeTestBackup(t, store, "index_1", 100, 0, true)
+	writeTestBackup(t, store, "index_1", 300, 0, false)
+	writeTestBackup(t, store, "index_2", 100, 0, true)
+	// Directories which are not timestamps are not backups.
+	writeTestObject(t, store, "index_2/tmp/object")
+
+	backups, err := ListBackups(&ListBackupConfig{BackupPath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timestamps := map[string][]int64{}
+	complete := map[string][]bool{}
+	for tableID, tableBackups := range backups {
+		for _, backup := range tableBackups {
+			timestamps[tableID] = append(timestamps[tableID], backup.Timestamp)
+			complete[tableID] = append(complete[tableID], backup.Complete())
+		}
+	}
+	if expected := map[string][]int64{"index_1": {100, 200, 300}, "index_2": {100}}; !reflect.DeepEqual(timestamps, expected) {
+		t.Errorf("Listed backups %v instead of %v", timestamps, expected)
+	}
+	if expected := map[string][]bool{"index_1": {true, true, false}, "index_2": {true}}; !reflect.DeepEqual(complete, expected) {
+		t.Errorf("Listed complete backups %v instead of %v", complete, expected)
+	}
+	if manifest := backups["index_1"][0].Manifest; manifest.BigtableTableID != "index_1" || len(manifest.Shards) != 1 {
+		t.Errorf("Unexpected manifest %+v", manifest)
+	}
+}
+
+func TestGetNewestBackupTimestamp(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	writeTestBackup(t, store, "index_1", 100, 0, true)
+	writeTestBackup(t, store, "index_1", 200, 0, true)
+	writeTestBackup(t, store, "index_1", 300, 0, false)
+
+	for _, tc := range []struct {
+		asOf     time.Time
+		expected int64
+		err      string
+	}{
+		{expected: 200},
+		{asOf: time.Unix(250, 0), expected: 200},
+		{asOf: time.Unix(200, 0), expected: 200},
+		{asOf: time.Unix(199, 0), expected: 100},
+		{asOf: time.Unix(99, 0), err: "No complete backups found at or before " + time.Unix(99, 0).Format(time.RFC3339)},
+	} {
+		timestamp, err := getNewestBackupTimestamp(path, "index_1", tc.asOf)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("Expected error %q as of %v, got %v", tc.err, tc.asOf, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error as of %v: %v", tc.asOf, err)
+			continue
+		}
+		if *timestamp != tc.expected {
+			t.Errorf("Newest backup as of %v is %d instead of %d", tc.asOf, *timestamp, tc.expected)
+		}
+	}
+
+	if _, err := getNewestBackupTimestamp(path, "index_2", time.Time{}); err == nil {
+		t.Error("Expected an error for a table without backups")
+	}
+}
+
+func TestGetNewestBackupTimestampWithoutManifests(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	writeTestBackup(t, store, "index_1", 100, 0, false)
+	writeTestBackup(t, store, "index_1", 200, 0, false)
+
+	for _, tc := range []struct {
+		asOf     time.Time
+		expected int64
+		err      string
+	}{
+		{expected: 200},
+		{asOf: time.Unix(150, 0), expected: 100},
+		{asOf: time.Unix(99, 0), err: "No complete backups found at or before " + time.Unix(99, 0).Format(time.RFC3339)},
+	} {
+		timestamp, err := getNewestBackupTimestamp(path, "index_1", tc.asOf)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("Expected error %q as of %v, got %v", tc.err, tc.asOf, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error as of %v: %v", tc.asOf, err)
+			continue
+		}
+		if *timestamp != tc.expected {
+			t.Errorf("Newest backup as of %v is %d instead of %d", tc.asOf, *timestamp, tc.expected)
+		}
+	}
+
+	// Once a backup of the table has a manifest, the backups without one are not picked anymore.
+	writeTestBackup(t, store, "index_1", 50, 0, true)
+	if timestamp, err := getNewestBackupTimestamp(path, "index_1", time.Time{}); err != nil || *timestamp != 50 {
+		t.Errorf("Expected the complete backup to be picked, got %v", err)
+	}
+	if _, err := getNewestBackupTimestamp(path, "index_1", time.Unix(49, 0)); err == nil {
+		t.Error("Expected an error without a complete backup as of the time")
+	}
+}
@@ -0,0 +1,436 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+
+	"github.com/grafana/bigtable-backup/pkg/seqfile"
+)
+
+const (
+	defaultShardSize         = 256 << 20
+	defaultImportParallelism = 8
+
+	// Limits of the batches of rows applied with a single MutateRows request.
+	maxRowsPerBatch      = 1000
+	maxMutationsPerBatch = 10000
+)
+
+// LocalJobRunner runs the jobs in-process with the Bigtable data API instead of Dataflow.
+// It writes SequenceFiles in the same format as the Dataflow templates, so the
+// backups can be restored by either runner. It connects to the Bigtable
+// emulator when BIGTABLE_EMULATOR_HOST is set.
+//
+// The jobs run synchronously: LaunchExport and LaunchImport return once the job is finished.
+type LocalJobRunner struct {
+	// ShardSize is the size in bytes after which the exported data is written to a new shard.
+	ShardSize int64
+	// ImportParallelism is the maximum number of concurrent MutateRows requests of an import.
+	ImportParallelism int
+
+	mtx  sync.Mutex
+	jobs map[string]JobState
+}
+
+// NewLocalJobRunner creates a LocalJobRunner.
+func NewLocalJobRunner() *LocalJobRunner {
+	return &LocalJobRunner{
+		ShardSize:         defaultShardSize,
+		ImportParallelism: defaultImportParallelism,
+		jobs:              map[string]JobState{},
+	}
+}
+
+// LaunchExport exports the table.
+func (r *LocalJobRunner) LaunchExport(ctx context.Context, job *ExportJob) (string, error) {
+	jobID := r.startJob(job.Name)
+	err := r.export(ctx, job)
+	r.finishJob(jobID, err)
+
+	return jobID, err
+}
+
+// LaunchImport imports the SequenceFiles to the table.
+func (r *LocalJobRunner) LaunchImport(ctx context.Context, job *ImportJob) (string, error) {
+	jobID := r.startJob(job.Name)
+	err := r.importTable(ctx, job)
+	r.finishJob(jobID, err)
+
+	return jobID, err
+}
+
+// GetJobState returns the final state of the job.
+func (r *LocalJobRunner) GetJobState(ctx context.Context, jobID string) (JobState, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	state, ok := r.jobs[jobID]
+	if !ok {
+		return JobStateUnknown, fmt.Errorf("Job with Id %s not found", jobID)
+	}
+
+	return state, nil
+}
+
+// CancelJob does nothing since the jobs are finished by the time they are launched.
+func (r *LocalJobRunner) CancelJob(ctx context.Context, jobID string) error {
+	_, err := r.GetJobState(ctx, jobID)
+	return err
+}
+
+func (r *LocalJobRunner) startJob(jobName string) string {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	jobID := fmt.Sprintf("local-%s-%d", jobName, len(r.jobs))
+	r.jobs[jobID] = JobStateRunning
+	return jobID
+}
+
+func (r *LocalJobRunner) finishJob(jobID string, err error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if err != nil {
+		r.jobs[jobID] = JobStateFailed
+	} else {
+		r.jobs[jobID] = JobStateDone
+	}
+}
+
+func (r *LocalJobRunner) export(ctx context.Context, job *ExportJob) error {
+	store, err := NewBackupStore(ctx, job.DestinationPath)
+	if err != nil {
+		return err
+	}
+
+	client, err := bigtable.NewClient(ctx, job.BigtableProjectID, job.BigtableInstanceID)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var opts []bigtable.ReadOption
+	incremental := !job.StartTime.IsZero()
+	if incremental {
+		// Incremental exports filter on the timestamps of the cells, so they would silently skip the cells written
+		// with timestamp 0, like the ones written by Cortex. Those cells are read as well to fail on the first of them.
+		opts = append(opts, bigtable.RowFilter(bigtable.InterleaveFilters(
+			bigtable.TimestampRangeFilter(job.StartTime, time.Time{}),
+			bigtable.TimestampRangeFilterMicros(0, 1000),
+		)))
+	}
+
+	table := client.Open(job.BigtableTableID)
+	w := &shardWriter{ctx: ctx, store: store, filenamePrefix: job.FilenamePrefix, shardSize: r.ShardSize}
+	// ReadRows returns nil when the callback stops it, so the error of the writer is kept separately.
+	var appendErr error
+	err = table.ReadRows(ctx, bigtable.InfiniteRange(""), func(row bigtable.Row) bool {
+		if incremental && hasZeroTimestamps(row) {
+			appendErr = fmt.Errorf("Incremental export of table with Id %s found cells with timestamp 0 in row %q, which incremental exports cannot back up, make full backups of this table instead", job.BigtableTableID, row.Key())
+			return false
+		}
+		appendErr = w.append(row)
+		return appendErr == nil
+	}, opts...)
+	if err == nil {
+		err = appendErr
+	}
+	if err != nil {
+		w.abort()
+		return err
+	}
+
+	return w.close()
+}
+
+// hasZeroTimestamps returns whether any cell of the row has timestamp 0.
+func hasZeroTimestamps(row bigtable.Row) bool {
+	for _, items := range row {
+		for _, item := range items {
+			if item.Timestamp == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// shardWriter writes the rows to SequenceFiles, starting a new shard every shardSize bytes.
+type shardWriter struct {
+	ctx            context.Context
+	store          BackupStore
+	filenamePrefix string
+	shardSize      int64
+
+	shards int
+	object ObjectWriter
+	writer *seqfile.Writer
+}
+
+func (w *shardWriter) append(row bigtable.Row) error {
+	if w.writer != nil && w.writer.Size() >= w.shardSize {
+		if err := w.closeShard(); err != nil {
+			return err
+		}
+	}
+
+	if w.writer == nil {
+		if err := w.openShard(); err != nil {
+			return err
+		}
+	}
+
+	return w.writer.Append(seqfile.EncodeRowKey([]byte(row.Key())), seqfile.EncodeResult(rowToCells(row)))
+}
+
+func (w *shardWriter) openShard() error {
+	object, err := w.store.NewWriter(w.ctx, fmt.Sprintf("%s-%05d", w.filenamePrefix, w.shards))
+	if err != nil {
+		return err
+	}
+
+	writer, err := seqfile.NewWriter(object, seqfile.Header{
+		KeyClassName:   seqfile.ImmutableBytesWritableClassName,
+		ValueClassName: seqfile.ResultClassName,
+	})
+	if err != nil {
+		object.Abort()
+		return err
+	}
+
+	w.shards++
+	w.object, w.writer = object, writer
+	return nil
+}
+
+func (w *shardWriter) closeShard() error {
+	err := w.writer.Close()
+	if closeErr := w.object.Close(); err == nil {
+		err = closeErr
+	}
+	w.object, w.writer = nil, nil
+	return err
+}
+
+func (w *shardWriter) close() error {
+	// Empty tables still get a shard so that their backups are listed.
+	if w.shards == 0 {
+		if err := w.openShard(); err != nil {
+			return err
+		}
+	}
+
+	if w.writer == nil {
+		return nil
+	}
+	return w.closeShard()
+}
+
+// abort discards the current shard, so that it is never mistaken for a complete one.
+// Like with failed Dataflow jobs, the shards written before it are left in the destination.
+func (w *shardWriter) abort() {
+	if w.object != nil {
+		w.object.Abort()
+		w.object, w.writer = nil, nil
+	}
+}
+
+// rowToCells converts the row to HBase cells, sorted the way HBase sorts them.
+func rowToCells(row bigtable.Row) []seqfile.Cell {
+	families := make([]string, 0, len(row))
+	for family := range row {
+		families = append(families, family)
+	}
+	sort.Strings(families)
+
+	var cells []seqfile.Cell
+	for _, family := range families {
+		// Bigtable returns the cells of a family sorted by qualifier and newest first.
+		for _, item := range row[family] {
+			cells = append(cells, seqfile.Cell{
+				Row:       []byte(item.Row),
+				Family:    []byte(family),
+				Qualifier: []byte(strings.TrimPrefix(item.Column, family+":")),
+				Timestamp: int64(item.Timestamp) / 1000,
+				Value:     item.Value,
+			})
+		}
+	}
+
+	return cells
+}
+
+func (r *LocalJobRunner) importTable(ctx context.Context, job *ImportJob) error {
+	store, err := NewBackupStore(ctx, job.SourcePath)
+	if err != nil {
+		return err
+	}
+
+	objects, err := store.ListObjects(ctx, job.FilenamePrefix)
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		return fmt.Errorf("No SequenceFiles found in %s", job.SourcePath)
+	}
+
+	client, err := bigtable.NewClient(ctx, job.BigtableProjectID, job.BigtableInstanceID)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	table := client.Open(job.BigtableTableID)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	batches := make(chan *mutationBatch)
+	errs := make(chan error, r.ImportParallelism)
+	var wg sync.WaitGroup
+	for i := 0; i < r.ImportParallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				if err := batch.apply(ctx, table); err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+
+	err = readMutationBatches(ctx, store, objects, job, batches)
+	close(batches)
+	wg.Wait()
+
+	// Errors applying the mutations cancel the reading, so they take precedence.
+	select {
+	case applyErr := <-errs:
+		return applyErr
+	default:
+		return err
+	}
+}
+
+// readMutationBatches reads the rows of the SequenceFiles imported by the job and sends them as batches of mutations.
+func readMutationBatches(ctx context.Context, store BackupStore, objects []ObjectAttrs, job *ImportJob, batches chan<- *mutationBatch) error {
+	batch := &mutationBatch{}
+	for _, object := range objects {
+		err := forEachRow(ctx, store, object.Name, func(rowKey []byte, cells []seqfile.Cell) error {
+			if !job.includesRow(rowKey) {
+				return nil
+			}
+
+			// An entry of a MutateRows request has at most 100000 mutations, so the cells
+			// of large rows are split across several entries of at most a batch each.
+			for len(cells) > 0 {
+				n := len(cells)
+				if n > maxMutationsPerBatch {
+					n = maxMutationsPerBatch
+				}
+
+				mutation := bigtable.NewMutation()
+				for _, cell := range cells[:n] {
+					mutation.Set(string(cell.Family), string(cell.Qualifier), bigtable.Timestamp(cell.Timestamp*1000), cell.Value)
+				}
+				batch.add(string(rowKey), mutation, n)
+				cells = cells[n:]
+
+				if batch.full() {
+					select {
+					case batches <- batch:
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+					batch = &mutationBatch{}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("Error reading %s with error: %s", object.Name, err)
+		}
+	}
+
+	if len(batch.rowKeys) > 0 {
+		select {
+		case batches <- batch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// forEachRow calls f with every row of a SequenceFile in the store.
+func forEachRow(ctx context.Context, store BackupStore, name string, f func(rowKey []byte, cells []seqfile.Cell) error) error {
+	object, err := store.NewReader(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+
+	reader, err := seqfile.NewReader(object)
+	if err != nil {
+		return err
+	}
+
+	for reader.Next() {
+		rowKey, err := seqfile.DecodeRowKey(reader.Key())
+		if err != nil {
+			return err
+		}
+		cells, err := seqfile.DecodeResult(reader.Value())
+		if err != nil {
+			return err
+		}
+
+		if err := f(rowKey, cells); err != nil {
+			return err
+		}
+	}
+
+	return reader.Err()
+}
+
+// mutationBatch is a batch of rows applied with a single MutateRows request.
+type mutationBatch struct {
+	rowKeys   []string
+	mutations []*bigtable.Mutation
+	cells     int
+}
+
+func (b *mutationBatch) add(rowKey string, mutation *bigtable.Mutation, cells int) {
+	b.rowKeys = append(b.rowKeys, rowKey)
+	b.mutations = append(b.mutations, mutation)
+	b.cells += cells
+}
+
+func (b *mutationBatch) full() bool {
+	return len(b.rowKeys) >= maxRowsPerBatch || b.cells >= maxMutationsPerBatch
+}
+
+func (b *mutationBatch) apply(ctx context.Context, table *bigtable.Table) error {
+	errs, err := table.ApplyBulk(ctx, b.rowKeys, b.mutations)
+	if err != nil {
+		return err
+	}
+
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("Error applying mutation to row %q with error: %s", b.rowKeys[i], err)
+		}
+	}
+
+	return nil
+}
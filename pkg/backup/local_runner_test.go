@@ -0,0 +1,468 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"cloud.google.com/go/bigtable/bttest"
+
+	"github.com/grafana/bigtable-backup/pkg/seqfile"
+)
+
+// newTestBigtable starts an in-memory Bigtable server, which the clients and the local runner connect to through BIGTABLE_EMULATOR_HOST.
+func newTestBigtable(t *testing.T) (*bigtable.Client, *bigtable.AdminClient, func()) {
+	srv, err := bttest.NewServer("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	emulatorHost, emulatorHostSet := os.LookupEnv("BIGTABLE_EMULATOR_HOST")
+	os.Setenv("BIGTABLE_EMULATOR_HOST", srv.Addr)
+	cleanup := func() {
+		if emulatorHostSet {
+			os.Setenv("BIGTABLE_EMULATOR_HOST", emulatorHost)
+		} else {
+			os.Unsetenv("BIGTABLE_EMULATOR_HOST")
+		}
+		srv.Close()
+	}
+
+	ctx := context.Background()
+	client, err := bigtable.NewClient(ctx, "project", "instance")
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	admin, err := bigtable.NewAdminClient(ctx, "project", "instance")
+	if err != nil {
+		client.Close()
+		cleanup()
+		t.Fatal(err)
+	}
+	return client, admin, func() {
+		admin.Close()
+		client.Close()
+		cleanup()
+	}
+}
+
+func createTestTable(t *testing.T, admin *bigtable.AdminClient, tableID string, families ...string) {
+	ctx := context.Background()
+	if err := admin.CreateTable(ctx, tableID); err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if err := admin.CreateColumnFamily(ctx, tableID, family); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readTestTable returns all the rows of the table by key.
+func readTestTable(t *testing.T, client *bigtable.Client, tableID string) map[string]bigtable.Row {
+	rows := map[string]bigtable.Row{}
+	err := client.Open(tableID).ReadRows(context.Background(), bigtable.InfiniteRange(""), func(row bigtable.Row) bool {
+		rows[row.Key()] = row
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+// readTestShards returns the rows of all the SequenceFiles with the prefix, and the number of SequenceFiles.
+func readTestShards(t *testing.T, store BackupStore, prefix string) (map[string][]seqfile.Cell, int) {
+	ctx := context.Background()
+	objects, err := store.ListObjects(ctx, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := map[string][]seqfile.Cell{}
+	for _, object := range objects {
+		err := forEachRow(ctx, store, object.Name, func(rowKey []byte, cells []seqfile.Cell) error {
+			rows[string(rowKey)] = cells
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rows, len(objects)
+}
+
+func runTestJob(t *testing.T, runner *LocalJobRunner, launch func(ctx context.Context) (string, error)) {
+	ctx := context.Background()
+	jobID, err := launch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state, err := runner.GetJobState(ctx, jobID); err != nil || state != JobStateDone {
+		t.Fatalf("Job with Id %s is in state %s, %v", jobID, state, err)
+	}
+}
+
+// ms returns the Bigtable timestamp of a time in milliseconds, which is the granularity of the timestamps of Bigtable.
+func ms(t int64) bigtable.Timestamp {
+	return bigtable.Timestamp(t * 1000)
+}
+
+func TestLocalJobRunnerExportImport(t *testing.T) {
+	client, admin, cleanup := newTestBigtable(t)
+	defer cleanup()
+	store, _, storeCleanup := newTestStore(t)
+	defer storeCleanup()
+
+	ctx := context.Background()
+	createTestTable(t, admin, "source", "a", "b")
+	var (
+		rowKeys   []string
+		mutations []*bigtable.Mutation
+	)
+	for i := 0; i < 50; i++ {
+		mutation := bigtable.NewMutation()
+		mutation.Set("b", "x", ms(2000), []byte(fmt.Sprintf("x-%d", i)))
+		mutation.Set("a", "z", ms(1000), []byte(fmt.Sprintf("z-%d", i)))
+		mutation.Set("a", "y", ms(1000), []byte(fmt.Sprintf("old-y-%d", i)))
+		mutation.Set("a", "y", ms(3000), []byte(fmt.Sprintf("y-%d", i)))
+		rowKeys = append(rowKeys, fmt.Sprintf("row-%03d", i))
+		mutations = append(mutations, mutation)
+	}
+	// Row keys are bytes rather than strings.
+	mutation := bigtable.NewMutation()
+	mutation.Set("a", "\x00\xff", ms(1000), []byte{0, 0xff})
+	rowKeys = append(rowKeys, "\x00\xff")
+	mutations = append(mutations, mutation)
+	if errs, err := client.Open("source").ApplyBulk(ctx, rowKeys, mutations); err != nil || errs != nil {
+		t.Fatal(err, errs)
+	}
+
+	runner := NewLocalJobRunner()
+	runner.ShardSize = 1024
+	runner.ImportParallelism = 2
+	runTestJob(t, runner, func(ctx context.Context) (string, error) {
+		return runner.LaunchExport(ctx, &ExportJob{
+			Name:               "export",
+			BigtableProjectID:  "project",
+			BigtableInstanceID: "instance",
+			BigtableTableID:    "source",
+			DestinationPath:    store.URL("source/100/"),
+			FilenamePrefix:     "source:",
+		})
+	})
+
+	rows, shards := readTestShards(t, store, "source/100/")
+	if shards < 2 {
+		t.Errorf("Expected several shards, got %d", shards)
+	}
+	if len(rows) != len(rowKeys) {
+		t.Fatalf("Exported %d rows instead of %d", len(rows), len(rowKeys))
+	}
+	// The cells are sorted by family and qualifier, newest first, with timestamps in milliseconds.
+	expected := []seqfile.Cell{
+		{Row: []byte("row-007"), Family: []byte("a"), Qualifier: []byte("y"), Timestamp: 3000, Value: []byte("y-7")},
+		{Row: []byte("row-007"), Family: []byte("a"), Qualifier: []byte("y"), Timestamp: 1000, Value: []byte("old-y-7")},
+		{Row: []byte("row-007"), Family: []byte("a"), Qualifier: []byte("z"), Timestamp: 1000, Value: []byte("z-7")},
+		{Row: []byte("row-007"), Family: []byte("b"), Qualifier: []byte("x"), Timestamp: 2000, Value: []byte("x-7")},
+	}
+	if !reflect.DeepEqual(rows["row-007"], expected) {
+		t.Errorf("Exported cells %+v instead of %+v", rows["row-007"], expected)
+	}
+
+	createTestTable(t, admin, "target", "a", "b")
+	runTestJob(t, runner, func(ctx context.Context) (string, error) {
+		return runner.LaunchImport(ctx, &ImportJob{
+			Name:               "import",
+			BigtableProjectID:  "project",
+			BigtableInstanceID: "instance",
+			BigtableTableID:    "target",
+			SourcePath:         store.URL("source/100/"),
+			FilenamePrefix:     "source:",
+		})
+	})
+	if source, target := readTestTable(t, client, "source"), readTestTable(t, client, "target"); !reflect.DeepEqual(target, source) {
+		t.Errorf("Imported rows %v instead of %v", target, source)
+	}
+}
+
+func TestLocalJobRunnerIncrementalExport(t *testing.T) {
+	client, admin, cleanup := newTestBigtable(t)
+	defer cleanup()
+	store, _, storeCleanup := newTestStore(t)
+	defer storeCleanup()
+
+	createTestTable(t, admin, "source", "a")
+	table := client.Open("source")
+	for i, timestamp := range []int64{1000, 2000, 3000} {
+		mutation := bigtable.NewMutation()
+		mutation.Set("a", "x", ms(timestamp), []byte(fmt.Sprintf("x-%d", i)))
+		if err := table.Apply(context.Background(), fmt.Sprintf("row-%d", i), mutation); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runner := NewLocalJobRunner()
+	runTestJob(t, runner, func(ctx context.Context) (string, error) {
+		return runner.LaunchExport(ctx, &ExportJob{
+			Name:               "export",
+			BigtableProjectID:  "project",
+			BigtableInstanceID: "instance",
+			BigtableTableID:    "source",
+			DestinationPath:    store.URL("source/200/"),
+			FilenamePrefix:     "source:",
+			StartTime:          time.Unix(2, 0),
+		})
+	})
+
+	// Only the cells written at or after the start time are exported.
+	rows, _ := readTestShards(t, store, "source/200/")
+	expected := map[string][]seqfile.Cell{
+		"row-1": {{Row: []byte("row-1"), Family: []byte("a"), Qualifier: []byte("x"), Timestamp: 2000, Value: []byte("x-1")}},
+		"row-2": {{Row: []byte("row-2"), Family: []byte("a"), Qualifier: []byte("x"), Timestamp: 3000, Value: []byte("x-2")}},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("Exported rows %+v instead of %+v", rows, expected)
+	}
+}
+
+func TestLocalJobRunnerIncrementalExportZeroTimestamps(t *testing.T) {
+	client, admin, cleanup := newTestBigtable(t)
+	defer cleanup()
+	store, _, storeCleanup := newTestStore(t)
+	defer storeCleanup()
+
+	// Only the last row has cells with timestamp 0, after rows which are exported.
+	createTestTable(t, admin, "source", "a")
+	table := client.Open("source")
+	for i, timestamp := range []int64{3000, 3000, 0} {
+		mutation := bigtable.NewMutation()
+		mutation.Set("a", "x", ms(timestamp), []byte(fmt.Sprintf("x-%d", i)))
+		if err := table.Apply(context.Background(), fmt.Sprintf("row-%d", i), mutation); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runner := NewLocalJobRunner()
+	runner.ShardSize = 1
+	_, err := runner.LaunchExport(context.Background(), &ExportJob{
+		Name:               "export",
+		BigtableProjectID:  "project",
+		BigtableInstanceID: "instance",
+		BigtableTableID:    "source",
+		DestinationPath:    store.URL("source/200/"),
+		FilenamePrefix:     "source:",
+		StartTime:          time.Unix(2, 0),
+	})
+	if err == nil || !strings.Contains(err.Error(), `cells with timestamp 0 in row "row-2"`) {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	// The shard of row-1 being written is discarded, while the one of row-0 is left like with failed Dataflow jobs.
+	if rows, shards := readTestShards(t, store, "source/200/"); shards != 1 || len(rows) != 1 || rows["row-0"] == nil {
+		t.Errorf("Expected the shard of row-0 written before the failure, got %d rows in %d shards", len(rows), shards)
+	}
+}
+
+func TestLocalJobRunnerExportEmptyTable(t *testing.T) {
+	_, admin, cleanup := newTestBigtable(t)
+	defer cleanup()
+	store, _, storeCleanup := newTestStore(t)
+	defer storeCleanup()
+
+	createTestTable(t, admin, "source", "a")
+	runner := NewLocalJobRunner()
+	runTestJob(t, runner, func(ctx context.Context) (string, error) {
+		return runner.LaunchExport(ctx, &ExportJob{
+			Name:               "export",
+			BigtableProjectID:  "project",
+			BigtableInstanceID: "instance",
+			BigtableTableID:    "source",
+			DestinationPath:    store.URL("source/100/"),
+			FilenamePrefix:     "source:",
+		})
+	})
+
+	// Empty tables still get a shard, so that their backups are listed.
+	if rows, shards := readTestShards(t, store, "source/100/"); len(rows) != 0 || shards != 1 {
+		t.Errorf("Exported %d rows in %d shards", len(rows), shards)
+	}
+}
+
+func TestLocalJobRunnerImportMissingShards(t *testing.T) {
+	_, admin, cleanup := newTestBigtable(t)
+	defer cleanup()
+	store, _, storeCleanup := newTestStore(t)
+	defer storeCleanup()
+
+	createTestTable(t, admin, "target", "a")
+	runner := NewLocalJobRunner()
+	jobID, err := runner.LaunchImport(context.Background(), &ImportJob{
+		Name:               "import",
+		BigtableProjectID:  "project",
+		BigtableInstanceID: "instance",
+		BigtableTableID:    "target",
+		SourcePath:         store.URL("source/100/"),
+		FilenamePrefix:     "source:",
+	})
+	if err == nil {
+		t.Fatal("Expected the import of a missing backup to fail")
+	}
+	if state, _ := runner.GetJobState(context.Background(), jobID); state != JobStateFailed {
+		t.Errorf("Job is in state %s instead of %s", state, JobStateFailed)
+	}
+}
+
+func TestHasZeroTimestamps(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		row      bigtable.Row
+		expected bool
+	}{
+		{
+			name: "cells written with timestamps",
+			row: bigtable.Row{"f": {
+				{Row: "row", Column: "f:a", Timestamp: 1558000000000000},
+				{Row: "row", Column: "f:b", Timestamp: 1558000001000000},
+			}},
+		},
+		{
+			name: "cells written with timestamp 0 like Cortex",
+			row: bigtable.Row{"f": {
+				{Row: "row", Column: "f:c", Timestamp: 0},
+			}},
+			expected: true,
+		},
+		{
+			name: "cells with timestamp 0 in one of the families",
+			row: bigtable.Row{
+				"f": {{Row: "row", Column: "f:a", Timestamp: 1558000000000000}},
+				"g": {{Row: "row", Column: "g:a", Timestamp: 0}},
+			},
+			expected: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := hasZeroTimestamps(tc.row); actual != tc.expected {
+				t.Errorf("Got %v instead of %v", actual, tc.expected)
+			}
+		})
+	}
+}
+
+func TestShardWriterAbort(t *testing.T) {
+	store, _, cleanup := newTestStore(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	w := &shardWriter{ctx: ctx, store: store, filenamePrefix: "index_1/100/index_1:", shardSize: 1}
+	for i := 0; i < 3; i++ {
+		row := bigtable.Row{"f": {{Row: fmt.Sprintf("row-%d", i), Column: "f:a", Timestamp: 1000, Value: []byte("value")}}}
+		if err := w.append(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.abort()
+
+	// The shards written before the failure are kept, but not the one being written.
+	objects, err := store.ListObjects(ctx, "index_1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, object := range objects {
+		names = append(names, object.Name)
+	}
+	if expected := []string{"index_1/100/index_1:-00000", "index_1/100/index_1:-00001"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Wrote shards %v instead of %v", names, expected)
+	}
+}
+
+// writeTestLargeRow writes a SequenceFile with a small row followed by a row with the given number of cells.
+func writeTestLargeRow(t *testing.T, store BackupStore, cells int) {
+	w := &shardWriter{ctx: context.Background(), store: store, filenamePrefix: "source/100/source:", shardSize: defaultShardSize}
+	rows := []bigtable.Row{
+		{"a": {{Row: "small", Column: "a:x", Timestamp: ms(1000), Value: []byte("x")}}},
+		{"a": make([]bigtable.ReadItem, cells)},
+	}
+	for i := range rows[1]["a"] {
+		rows[1]["a"][i] = bigtable.ReadItem{Row: "large", Column: fmt.Sprintf("a:%05d", i), Timestamp: ms(1000), Value: []byte("v")}
+	}
+	for _, row := range rows {
+		if err := w.append(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadMutationBatches(t *testing.T) {
+	store, _, cleanup := newTestStore(t)
+	defer cleanup()
+	writeTestLargeRow(t, store, 2*maxMutationsPerBatch+500)
+
+	ctx := context.Background()
+	objects, err := store.ListObjects(ctx, "source/100/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	batches := make(chan *mutationBatch)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- readMutationBatches(ctx, store, objects, &ImportJob{}, batches)
+		close(batches)
+	}()
+
+	// The large row is split across several entries, none of them with more mutations than a batch.
+	var (
+		rowKeys []string
+		cells   []int
+	)
+	for batch := range batches {
+		rowKeys = append(rowKeys, batch.rowKeys...)
+		cells = append(cells, batch.cells)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"small", "large", "large", "large"}; !reflect.DeepEqual(rowKeys, expected) {
+		t.Errorf("Batched rows %v instead of %v", rowKeys, expected)
+	}
+	if expected := []int{1 + maxMutationsPerBatch, maxMutationsPerBatch, 500}; !reflect.DeepEqual(cells, expected) {
+		t.Errorf("Batched %v cells instead of %v", cells, expected)
+	}
+}
+
+func TestLocalJobRunnerImportLargeRow(t *testing.T) {
+	client, admin, cleanup := newTestBigtable(t)
+	defer cleanup()
+	store, _, storeCleanup := newTestStore(t)
+	defer storeCleanup()
+	writeTestLargeRow(t, store, 2*maxMutationsPerBatch+500)
+
+	createTestTable(t, admin, "target", "a")
+	runner := NewLocalJobRunner()
+	runner.ImportParallelism = 2
+	runTestJob(t, runner, func(ctx context.Context) (string, error) {
+		return runner.LaunchImport(ctx, &ImportJob{
+			Name:               "import",
+			BigtableProjectID:  "project",
+			BigtableInstanceID: "instance",
+			BigtableTableID:    "target",
+			SourcePath:         store.URL("source/100/"),
+			FilenamePrefix:     "source:",
+		})
+	})
+
+	rows := readTestTable(t, client, "target")
+	if len(rows) != 2 || len(rows["large"]["a"]) != 2*maxMutationsPerBatch+500 || len(rows["small"]["a"]) != 1 {
+		t.Errorf("Imported %d rows, with %d and %d cells", len(rows), len(rows["large"]["a"]), len(rows["small"]["a"]))
+	}
+}
@@ -0,0 +1,158 @@
+package backup
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// localStore keeps the backups in a directory on the local filesystem.
+type localStore struct {
+	root string
+}
+
+func newLocalStore(root string) (*localStore, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	return &localStore{root: root}, nil
+}
+
+func (s *localStore) ListObjects(ctx context.Context, prefix string) ([]ObjectAttrs, error) {
+	// Only walk the directory which can contain objects with the prefix.
+	walkRoot := s.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		walkRoot = s.path(prefix[:i])
+	}
+
+	var objects []ObjectAttrs
+	err := filepath.Walk(walkRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		// Skip directories and the temporary files of writers in progress.
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+
+		name, err := filepath.Rel(s.root, path)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if strings.HasPrefix(name, prefix) {
+			objects = append(objects, ObjectAttrs{Name: name, Size: info.Size()})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return objects, nil
+}
+
+func (s *localStore) ListPrefixes(ctx context.Context, prefix string) ([]string, error) {
+	dir, namePrefix := s.root, prefix
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir, namePrefix = s.path(prefix[:i]), prefix[i+1:]
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var prefixes []string
+	for _, info := range infos {
+		if info.IsDir() && strings.HasPrefix(info.Name(), namePrefix) {
+			prefixes = append(prefixes, info.Name()[len(namePrefix):])
+		}
+	}
+	sort.Strings(prefixes)
+
+	return prefixes, nil
+}
+
+func (s *localStore) NewReader(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(s.path(name))
+}
+
+func (s *localStore) NewWriter(ctx context.Context, name string) (ObjectWriter, error) {
+	path := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	// Write to a temporary file so that partially written objects are never visible.
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	return &localWriter{File: f, path: path}, nil
+}
+
+func (s *localStore) DeleteObject(ctx context.Context, name string) error {
+	path := s.path(name)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+
+	// Remove the directories left empty, like GCS does not keep empty prefixes.
+	for dir := filepath.Dir(path); dir != s.root && strings.HasPrefix(dir, s.root); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (s *localStore) URL(name string) string {
+	url := localScheme + filepath.ToSlash(s.path(name))
+	if strings.HasSuffix(name, "/") {
+		url += "/"
+	}
+	return url
+}
+
+func (s *localStore) path(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(name))
+}
+
+type localWriter struct {
+	*os.File
+	path string
+}
+
+func (w *localWriter) Close() error {
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.File.Name())
+		return err
+	}
+
+	// Temporary files are only readable by their owner.
+	if err := os.Chmod(w.File.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(w.File.Name(), w.path)
+}
+
+func (w *localWriter) Abort() {
+	w.File.Close()
+	os.Remove(w.File.Name())
+}
@@ -0,0 +1,105 @@
+package backup
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLocalStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bigtable-backup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := newLocalStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, name := range []string{"index_1/100/index_1:0", "index_1/100/manifest.json", "index_1/200/index_1:0", "index_10/100/index_10:0"} {
+		writeTestObject(t, store, name)
+	}
+
+	// Objects being written are not listed.
+	w, err := store.NewWriter(ctx, "index_1/100/index_1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	prefixes, err := store.ListPrefixes(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"index_1", "index_10"}; !reflect.DeepEqual(prefixes, expected) {
+		t.Errorf("Listed prefixes %v instead of %v", prefixes, expected)
+	}
+	if prefixes, err = store.ListPrefixes(ctx, "index_1/"); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"100", "200"}; !reflect.DeepEqual(prefixes, expected) {
+		t.Errorf("Listed prefixes %v instead of %v", prefixes, expected)
+	}
+	if prefixes, err = store.ListPrefixes(ctx, "missing/"); err != nil || len(prefixes) != 0 {
+		t.Errorf("Expected no prefixes of a missing directory, got %v, %v", prefixes, err)
+	}
+
+	for prefix, expected := range map[string][]string{
+		"index_1/":      {"index_1/100/index_1:0", "index_1/100/manifest.json", "index_1/200/index_1:0"},
+		"index_1":       {"index_1/100/index_1:0", "index_1/100/manifest.json", "index_1/200/index_1:0", "index_10/100/index_10:0"},
+		"index_1/100/m": {"index_1/100/manifest.json"},
+		"missing/":      nil,
+	} {
+		objects, err := store.ListObjects(ctx, prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, object := range objects {
+			names = append(names, object.Name)
+			if object.Size != int64(len(object.Name)) {
+				t.Errorf("Object %s has size %d", object.Name, object.Size)
+			}
+		}
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("Listed objects %v with prefix %s instead of %v", names, prefix, expected)
+		}
+	}
+
+	// The directories left empty are removed.
+	if err := store.DeleteObject(ctx, "index_10/100/index_10:0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "index_10")); !os.IsNotExist(err) {
+		t.Errorf("Expected the empty directories to be removed, got %v", err)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Errorf("Expected the root to be kept, got %v", err)
+	}
+	if err := store.DeleteObject(ctx, "index_10/100/index_10:0"); !isNotExist(err) {
+		t.Errorf("Expected a not exist error deleting a missing object, got %v", err)
+	}
+
+	// Aborted writers leave neither the object nor their temporary file.
+	w, err = store.NewWriter(ctx, "index_2/100/index_2:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("partial")); err != nil {
+		t.Fatal(err)
+	}
+	w.Abort()
+	if infos, err := ioutil.ReadDir(filepath.Join(dir, "index_2", "100")); err != nil || len(infos) != 0 {
+		t.Errorf("Expected no files left by the aborted writer, got %v, %v", infos, err)
+	}
+
+	if url := store.URL("index_1/100/"); !strings.HasPrefix(url, localScheme) || !strings.HasSuffix(url, "/index_1/100/") {
+		t.Errorf("Unexpected URL %s", url)
+	}
+}
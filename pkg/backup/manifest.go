@@ -0,0 +1,132 @@
+package backup
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+
+	bigtableAdminV2 "google.golang.org/api/bigtableadmin/v2"
+)
+
+const manifestFileName = "manifest.json"
+
+// Version is the version of bigtable-backup, set at build time.
+var Version = "unknown"
+
+// Manifest describes a backup. It is written next to the SequenceFiles once they have all been written,
+// so backups without a manifest are incomplete.
+type Manifest struct {
+	BigtableProjectID  string `json:"bigtable_project_id"`
+	BigtableInstanceID string `json:"bigtable_instance_id"`
+	BigtableTableID    string `json:"bigtable_table_id"`
+	Timestamp          int64  `json:"timestamp"`
+	Runner             string `json:"runner"`
+	JobID              string `json:"job_id"`
+	// TemplatePath is the path of the Dataflow template which exported the table, if any.
+	TemplatePath   string                                  `json:"template_path,omitempty"`
+	Shards         []ManifestShard                         `json:"shards"`
+	Version        string                                  `json:"version"`
+	ColumnFamilies map[string]bigtableAdminV2.ColumnFamily `json:"column_families"`
+	Granularity    string                                  `json:"granularity,omitempty"`
+	CreatedAt      time.Time                               `json:"created_at"`
+	// Parent is the timestamp of the backup an incremental backup was made since. The backup only has
+	// the cells written since then, and is restored after the chain of its parents. Zero for full backups.
+	Parent int64 `json:"parent,omitempty"`
+	// Backfilled is set for the manifests written by BackfillManifest for the backups made before manifests were written.
+	Backfilled bool `json:"backfilled,omitempty"`
+}
+
+// ManifestShard describes a SequenceFile of a backup. The checksums are base64 encoded, like GCS reports them.
+type ManifestShard struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	CRC32C string `json:"crc32c"`
+	MD5    string `json:"md5"`
+}
+
+func manifestName(tableID string, timestamp int64) string {
+	return fmt.Sprintf("%s/%d/%s", tableID, timestamp, manifestFileName)
+}
+
+// listShards lists the SequenceFiles of a backup with their checksums.
+// The checksums not kept by the store are computed by reading the SequenceFiles.
+func listShards(ctx context.Context, store BackupStore, tableID string, timestamp int64) ([]ManifestShard, error) {
+	objects, err := store.ListObjects(ctx, fmt.Sprintf("%s/%d/%s%s", tableID, timestamp, tableID, bigtableIDSeparatorInSeqFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	shards := make([]ManifestShard, 0, len(objects))
+	for _, object := range objects {
+		shard := ManifestShard{Name: object.Name, Size: object.Size, CRC32C: object.CRC32C, MD5: object.MD5}
+		if shard.CRC32C == "" || shard.MD5 == "" {
+			if shard.CRC32C, shard.MD5, err = computeChecksums(ctx, store, object.Name); err != nil {
+				return nil, fmt.Errorf("Error computing checksums of %s with error: %s", object.Name, err)
+			}
+		}
+		shards = append(shards, shard)
+	}
+
+	return shards, nil
+}
+
+func computeChecksums(ctx context.Context, store BackupStore, name string) (crc32c, md5Hash string, err error) {
+	r, err := store.NewReader(ctx, name)
+	if err != nil {
+		return "", "", err
+	}
+	defer r.Close()
+
+	crc32cHash := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	md5Hasher := md5.New()
+	if _, err := io.Copy(io.MultiWriter(crc32cHash, md5Hasher), r); err != nil {
+		return "", "", err
+	}
+
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32cHash.Sum32())
+	return base64.StdEncoding.EncodeToString(crc[:]), base64.StdEncoding.EncodeToString(md5Hasher.Sum(nil)), nil
+}
+
+func writeManifest(ctx context.Context, store BackupStore, manifest *Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	w, err := store.NewWriter(ctx, manifestName(manifest.BigtableTableID, manifest.Timestamp))
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Abort()
+		return err
+	}
+
+	return w.Close()
+}
+
+// readManifest reads the manifest of a backup. It returns nil if the backup has no manifest.
+func readManifest(ctx context.Context, store BackupStore, tableID string, timestamp int64) (*Manifest, error) {
+	r, err := store.NewReader(ctx, manifestName(tableID, timestamp))
+	if err != nil {
+		if isNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer r.Close()
+
+	var manifest Manifest
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("Error reading manifest of backup of table %s with timestamp %d with error: %s", tableID, timestamp, err)
+	}
+
+	return &manifest, nil
+}
@@ -0,0 +1,83 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+const (
+	metricsNamespace = "bigtable_backup"
+	pushJobName      = "bigtable-backup"
+)
+
+var (
+	lastSuccessfulBackupTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_successful_backup_timestamp_seconds",
+		Help:      "Unix timestamp of the last successful backup of the table.",
+	}, []string{"table"})
+	jobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "job_duration_seconds",
+		Help:      "Duration of the export and import jobs, from their launch until they finish.",
+		Buckets:   prometheus.ExponentialBuckets(10, 2, 12),
+	}, []string{"type"})
+	jobFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "job_failures_total",
+		Help:      "Total number of failed export and import jobs by their final state.",
+	}, []string{"type", "state"})
+	backupBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "written_bytes_total",
+		Help:      "Total size of the SequenceFiles of the successful backups of the table.",
+	}, []string{"table"})
+	prunedBackups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "pruned_backups_total",
+		Help:      "Total number of backups of the table deleted by prune.",
+	}, []string{"table"})
+
+	collectors = []prometheus.Collector{lastSuccessfulBackupTimestamp, jobDuration, jobFailures, backupBytes, prunedBackups}
+)
+
+// Types of the jobs in the metrics.
+const (
+	exportJobType = "export"
+	importJobType = "import"
+)
+
+func init() {
+	prometheus.MustRegister(collectors...)
+}
+
+// recordJobFailure counts a failed job. Jobs which failed before having a state are counted with JOB_STATE_UNKNOWN.
+func recordJobFailure(jobType string, state JobState) {
+	if state == "" {
+		state = JobStateUnknown
+	}
+	jobFailures.WithLabelValues(jobType, string(state)).Inc()
+}
+
+// pushMetrics pushes the metrics to the Pushgateway, if any, in the group of the command.
+// Errors are only printed, so they never fail the command.
+func pushMetrics(pushgatewayURL string, grouping map[string]string) {
+	if pushgatewayURL == "" {
+		return
+	}
+
+	pusher := push.New(pushgatewayURL, pushJobName)
+	for name, value := range grouping {
+		pusher.Grouping(name, value)
+	}
+	for _, collector := range collectors {
+		pusher.Collector(collector)
+	}
+
+	if err := pusher.Add(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error pushing metrics to %s with error: %s\n", pushgatewayURL, err)
+	}
+}
@@ -0,0 +1,104 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// Selections of the periodic tables.
+const (
+	periodicTablesAll      = "all"
+	periodicTablesActive   = "active"
+	periodicTablesInactive = "inactive"
+)
+
+// PeriodicTableConfig selects tables of a periodic table config, like the ones of Cortex and Loki.
+// The ID of a periodic table is the prefix followed by the number of periods since the Unix epoch, e.g. index_2650 for weekly tables.
+type PeriodicTableConfig struct {
+	// Period of the tables. Zero disables the selection.
+	Period time.Duration
+	// From is the date of the first table, in YYYY-MM-DD format. The older tables are not selected.
+	From string
+	// Last only selects the tables of the last N periods, up to the current one. Zero selects all the tables.
+	Last int
+	// Select is either all, active or inactive.
+	Select string
+	// GracePeriod is how long a table is still written to once its period is over.
+	GracePeriod time.Duration
+}
+
+func registerPeriodicTableFlags(cmd *kingpin.CmdClause, config *PeriodicTableConfig) {
+	cmd.Flag("periodic-table-period", "Period of the tables, e.g. 168h for weekly tables. "+
+		"When set, only the tables with IDs made of the prefix and a period number are backed up").DurationVar(&config.Period)
+	cmd.Flag("periodic-table-from", "Date of the first periodic table in YYYY-MM-DD format. Older tables are not backed up").StringVar(&config.From)
+	cmd.Flag("periodic-table-last", "Only back up the tables of the last N periods, up to the current one").IntVar(&config.Last)
+	cmd.Flag("periodic-table-select", "Periodic tables to back up. Either all, active for the tables still written to, "+
+		"or inactive for the tables no longer written to").Default(periodicTablesAll).EnumVar(&config.Select, periodicTablesAll, periodicTablesActive, periodicTablesInactive)
+	cmd.Flag("periodic-table-grace-period", "How long a periodic table is still written to once its period is over").DurationVar(&config.GracePeriod)
+}
+
+// selectPeriodicTables returns the IDs of the periodic tables with the prefix which are selected by the config, sorted by period.
+// Tables whose IDs are not the prefix followed by a period number are not selected.
+func selectPeriodicTables(tableIDs []string, prefix string, config *PeriodicTableConfig, now time.Time) ([]string, error) {
+	periodSecs := int64(config.Period / time.Second)
+	if periodSecs <= 0 {
+		return nil, errors.New("Period of periodic tables must be at least one second")
+	}
+
+	var first int64
+	if config.From != "" {
+		from, err := time.Parse("2006-01-02", config.From)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid date %s of the first periodic table with error: %s", config.From, err)
+		}
+		first = from.Unix() / periodSecs
+	}
+	current := now.Unix() / periodSecs
+
+	periods := map[string]int64{}
+	selected := make([]string, 0, len(tableIDs))
+	for _, tableID := range tableIDs {
+		period, ok := tablePeriod(tableID, prefix)
+		if !ok || period < first {
+			continue
+		}
+		if config.Last > 0 && (period <= current-int64(config.Last) || period > current) {
+			continue
+		}
+
+		// Tables of future periods are about to be written to.
+		inactive := !config.writtenUntil(period).After(now)
+		if (config.Select == periodicTablesActive && inactive) || (config.Select == periodicTablesInactive && !inactive) {
+			continue
+		}
+
+		periods[tableID] = period
+		selected = append(selected, tableID)
+	}
+
+	sort.Slice(selected, func(i, j int) bool {
+		return periods[selected[i]] < periods[selected[j]]
+	})
+	return selected, nil
+}
+
+// tablePeriod returns the period number of a periodic table, if its ID is the prefix followed by a period number.
+func tablePeriod(tableID, prefix string) (int64, bool) {
+	suffix := strings.TrimPrefix(tableID, prefix)
+	if !strings.HasPrefix(tableID, prefix) || !numbersOnlyRegex.MatchString(suffix) {
+		return 0, false
+	}
+	period, err := strconv.ParseInt(suffix, 10, 64)
+	return period, err == nil
+}
+
+// writtenUntil returns when the table of a period stops being written to, which is the grace period after the end of the period.
+func (c *PeriodicTableConfig) writtenUntil(period int64) time.Time {
+	return time.Unix((period+1)*int64(c.Period/time.Second), 0).Add(c.GracePeriod)
+}
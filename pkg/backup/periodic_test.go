@@ -0,0 +1,96 @@
+package backup
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSelectPeriodicTables(t *testing.T) {
+	const week = 7 * 24 * time.Hour
+	// An hour into the weekly period 2650, which starts on 2020-10-15.
+	now := time.Unix(2650*int64(week/time.Second), 0).Add(time.Hour)
+	tableIDs := []string{
+		"index_2651", "index_2649", "index_2647", "index_2650", "index_2648",
+		"index_abc", "index_2650x", "index_+2650", "index_-1", "index_", "chunks_2650",
+	}
+
+	for _, tc := range []struct {
+		name     string
+		config   PeriodicTableConfig
+		expected []string
+		err      bool
+	}{
+		{
+			name:     "all the tables with a period number",
+			config:   PeriodicTableConfig{Period: week, Select: periodicTablesAll},
+			expected: []string{"index_2647", "index_2648", "index_2649", "index_2650", "index_2651"},
+		},
+		{
+			name:     "from a date in the middle of a period",
+			config:   PeriodicTableConfig{Period: week, From: "2020-10-04", Select: periodicTablesAll},
+			expected: []string{"index_2648", "index_2649", "index_2650", "index_2651"},
+		},
+		{
+			name:     "from the first day of a period",
+			config:   PeriodicTableConfig{Period: week, From: "2020-10-08", Select: periodicTablesAll},
+			expected: []string{"index_2649", "index_2650", "index_2651"},
+		},
+		{
+			name:     "last periods without the future ones",
+			config:   PeriodicTableConfig{Period: week, Last: 2, Select: periodicTablesAll},
+			expected: []string{"index_2649", "index_2650"},
+		},
+		{
+			name:     "active tables",
+			config:   PeriodicTableConfig{Period: week, Select: periodicTablesActive},
+			expected: []string{"index_2650", "index_2651"},
+		},
+		{
+			name:     "inactive tables",
+			config:   PeriodicTableConfig{Period: week, Select: periodicTablesInactive},
+			expected: []string{"index_2647", "index_2648", "index_2649"},
+		},
+		{
+			name:     "active tables within the grace period",
+			config:   PeriodicTableConfig{Period: week, Select: periodicTablesActive, GracePeriod: 2 * time.Hour},
+			expected: []string{"index_2649", "index_2650", "index_2651"},
+		},
+		{
+			name:     "inactive tables after the grace period",
+			config:   PeriodicTableConfig{Period: week, Select: periodicTablesInactive, GracePeriod: time.Hour},
+			expected: []string{"index_2647", "index_2648", "index_2649"},
+		},
+		{
+			name:     "inactive tables of the last periods",
+			config:   PeriodicTableConfig{Period: week, Last: 3, Select: periodicTablesInactive},
+			expected: []string{"index_2648", "index_2649"},
+		},
+		{
+			name:   "period under a second",
+			config: PeriodicTableConfig{Period: time.Millisecond, Select: periodicTablesAll},
+			err:    true,
+		},
+		{
+			name:   "invalid from date",
+			config: PeriodicTableConfig{Period: week, From: "15/10/2020", Select: periodicTablesAll},
+			err:    true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			selected, err := selectPeriodicTables(tableIDs, "index_", &tc.config, now)
+			if tc.err {
+				if err == nil {
+					t.Errorf("Expected an error, selected %v", selected)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(selected, tc.expected) {
+				t.Errorf("Selected %v instead of %v", selected, tc.expected)
+			}
+		})
+	}
+}
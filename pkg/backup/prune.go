@@ -0,0 +1,182 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// PruneBackupsConfig has the config for PruneBackups command.
+type PruneBackupsConfig struct {
+	BackupPath            string
+	BigtableTableIDPrefix string
+	KeepLast              int
+	KeepWithin            time.Duration
+	KeepDaily             int
+	KeepWeekly            int
+	KeepMonthly           int
+	DryRun                bool
+	// IncompleteGracePeriod is how long the incomplete backups made after a complete backup are kept,
+	// since they may still be in progress. Defaults to 48 hours.
+	IncompleteGracePeriod time.Duration
+}
+
+const defaultIncompleteGracePeriod = 48 * time.Hour
+
+// RegisterPruneBackupsFlags registers the flags for PruneBackups command.
+func RegisterPruneBackupsFlags(cmd *kingpin.CmdClause) *PruneBackupsConfig {
+	config := PruneBackupsConfig{}
+	cmd.Flag("backup-path", "Path where backups can be found. Supports gs:// and file:// paths").Required().StringVar(&config.BackupPath)
+	cmd.Flag("bigtable-table-id-prefix", "Only prune the backups of the tables with IDs starting with this prefix").StringVar(&config.BigtableTableIDPrefix)
+	cmd.Flag("keep-last", "Keep the N most recent backups of every table").IntVar(&config.KeepLast)
+	cmd.Flag("keep-within", "Keep the backups created within this duration, e.g. 720h").DurationVar(&config.KeepWithin)
+	cmd.Flag("keep-daily", "Keep the most recent backup of each of the last N days with backups").IntVar(&config.KeepDaily)
+	cmd.Flag("keep-weekly", "Keep the most recent backup of each of the last N weeks with backups").IntVar(&config.KeepWeekly)
+	cmd.Flag("keep-monthly", "Keep the most recent backup of each of the last N months with backups").IntVar(&config.KeepMonthly)
+	cmd.Flag("dry-run", "Only print the backups which would be deleted").BoolVar(&config.DryRun)
+	cmd.Flag("incomplete-grace-period", "How long the incomplete backups made after a complete backup are kept, since they may still be in progress").
+		Default(defaultIncompleteGracePeriod.String()).DurationVar(&config.IncompleteGracePeriod)
+	return &config
+}
+
+// PruneBackups deletes the backups which are not kept by any of the retention policies.
+// Incomplete backups made after a complete backup are deleted once they are older than the grace period.
+// Incomplete backups older than all the complete backups may have been made before manifests were written,
+// so the retention policies apply to them on their own.
+func PruneBackups(config *PruneBackupsConfig) error {
+	if config.KeepLast <= 0 && config.KeepWithin <= 0 && config.KeepDaily <= 0 && config.KeepWeekly <= 0 && config.KeepMonthly <= 0 {
+		return errors.New("No retention policy set, at least one of the --keep flags is required")
+	}
+
+	backups, err := ListBackups(&ListBackupConfig{BackupPath: config.BackupPath})
+	if err != nil {
+		return err
+	}
+
+	tableIDs := make([]string, 0, len(backups))
+	for tableID := range backups {
+		if strings.HasPrefix(tableID, config.BigtableTableIDPrefix) {
+			tableIDs = append(tableIDs, tableID)
+		}
+	}
+	sort.Strings(tableIDs)
+
+	now := time.Now()
+	for _, tableID := range tableIDs {
+		for _, timestamp := range backupsToPrune(config, backups[tableID], now) {
+			if config.DryRun {
+				fmt.Printf("Would delete backup for table %s with timestamp %d\n", tableID, timestamp)
+				continue
+			}
+
+			err := DeleteBackup(&DeleteBackupConfig{
+				BigtableTableID: tableID,
+				BackupPath:      config.BackupPath,
+				BackupTimestamp: strconv.FormatInt(timestamp, 10),
+			})
+			if err != nil {
+				return err
+			}
+			prunedBackups.WithLabelValues(tableID).Inc()
+		}
+	}
+
+	return nil
+}
+
+// backupsToPrune returns the timestamps of the backups of a table which are not kept by any of the retention policies.
+// The backups are sorted by timestamp.
+func backupsToPrune(config *PruneBackupsConfig, backups []Backup, now time.Time) []int64 {
+	gracePeriod := config.IncompleteGracePeriod
+	if gracePeriod <= 0 {
+		gracePeriod = defaultIncompleteGracePeriod
+	}
+
+	// The incomplete backups made after a complete backup failed, unless they are still in progress.
+	// The other ones may be complete backups made before manifests were written.
+	var complete, legacy []int64
+	keep := map[int64]bool{}
+	for _, backup := range backups {
+		switch {
+		case backup.Complete():
+			complete = append(complete, backup.Timestamp)
+		case len(complete) == 0:
+			legacy = append(legacy, backup.Timestamp)
+		case now.Sub(time.Unix(backup.Timestamp, 0)) <= gracePeriod:
+			keep[backup.Timestamp] = true
+		}
+	}
+
+	// The retention policies apply to the complete backups, and separately to the legacy ones so that they never take the place of complete backups.
+	keepByPolicies(config, keep, complete, now)
+	keepByPolicies(config, keep, legacy, now)
+
+	// Incremental backups can only be restored with their parents, so the parents of the kept backups are kept too.
+	parents := make(map[int64]int64, len(backups))
+	for _, backup := range backups {
+		if backup.Complete() {
+			parents[backup.Timestamp] = backup.Manifest.Parent
+		}
+	}
+	for timestamp := range keep {
+		for parent := parents[timestamp]; parent != 0 && !keep[parent]; parent = parents[parent] {
+			keep[parent] = true
+		}
+	}
+
+	var prune []int64
+	for _, backup := range backups {
+		if !keep[backup.Timestamp] {
+			prune = append(prune, backup.Timestamp)
+		}
+	}
+	return prune
+}
+
+// keepByPolicies keeps the backups kept by any of the retention policies. The timestamps must be sorted oldest first.
+func keepByPolicies(config *PruneBackupsConfig, keep map[int64]bool, timestamps []int64, now time.Time) {
+	newestFirst := make([]int64, 0, len(timestamps))
+	for i := len(timestamps) - 1; i >= 0; i-- {
+		newestFirst = append(newestFirst, timestamps[i])
+	}
+
+	for i, timestamp := range newestFirst {
+		if i < config.KeepLast {
+			keep[timestamp] = true
+		}
+		if config.KeepWithin > 0 && now.Sub(time.Unix(timestamp, 0)) <= config.KeepWithin {
+			keep[timestamp] = true
+		}
+	}
+
+	keepPerPeriod(keep, newestFirst, config.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") })
+	keepPerPeriod(keep, newestFirst, config.KeepWeekly, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-%d", year, week)
+	})
+	keepPerPeriod(keep, newestFirst, config.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") })
+}
+
+// keepPerPeriod keeps the newest backup of each of the last n periods with backups.
+// The timestamps must be sorted newest first.
+func keepPerPeriod(keep map[int64]bool, timestamps []int64, n int, period func(time.Time) string) {
+	lastPeriod := ""
+	for _, timestamp := range timestamps {
+		if n <= 0 {
+			return
+		}
+
+		p := period(time.Unix(timestamp, 0).UTC())
+		if p == lastPeriod {
+			continue
+		}
+		keep[timestamp] = true
+		lastPeriod = p
+		n--
+	}
+}
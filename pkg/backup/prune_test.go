@@ -0,0 +1,134 @@
+package backup
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBackupsToPrune(t *testing.T) {
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	ago := func(d time.Duration) int64 { return now.Add(-d).Unix() }
+	day := 24 * time.Hour
+
+	complete := func(timestamp int64) Backup {
+		return Backup{Timestamp: timestamp, Manifest: &Manifest{Timestamp: timestamp}}
+	}
+	incremental := func(timestamp, parent int64) Backup {
+		return Backup{Timestamp: timestamp, Manifest: &Manifest{Timestamp: timestamp, Parent: parent}}
+	}
+	incomplete := func(timestamp int64) Backup {
+		return Backup{Timestamp: timestamp}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		config   PruneBackupsConfig
+		backups  []Backup
+		expected []int64
+	}{
+		{
+			name:     "keep last",
+			config:   PruneBackupsConfig{KeepLast: 2},
+			backups:  []Backup{complete(ago(3 * day)), complete(ago(2 * day)), complete(ago(day))},
+			expected: []int64{ago(3 * day)},
+		},
+		{
+			name:     "keep within",
+			config:   PruneBackupsConfig{KeepWithin: 36 * time.Hour},
+			backups:  []Backup{complete(ago(3 * day)), complete(ago(2 * day)), complete(ago(day))},
+			expected: []int64{ago(3 * day), ago(2 * day)},
+		},
+		{
+			name:     "keep daily",
+			config:   PruneBackupsConfig{KeepDaily: 2},
+			backups:  []Backup{complete(ago(50 * time.Hour)), complete(ago(26 * time.Hour)), complete(ago(25 * time.Hour)), complete(ago(time.Hour))},
+			expected: []int64{ago(50 * time.Hour), ago(26 * time.Hour)},
+		},
+		{
+			// Backups made before manifests were written are not deleted after the first backup with a manifest.
+			name:     "legacy backups kept by the policies",
+			config:   PruneBackupsConfig{KeepWithin: 720 * time.Hour, KeepLast: 5},
+			backups:  []Backup{incomplete(ago(2 * day)), incomplete(ago(day)), complete(ago(time.Hour))},
+			expected: nil,
+		},
+		{
+			name:     "legacy backups do not take the place of complete backups",
+			config:   PruneBackupsConfig{KeepLast: 1},
+			backups:  []Backup{incomplete(ago(40 * day)), incomplete(ago(30 * day)), complete(ago(2 * day)), complete(ago(day))},
+			expected: []int64{ago(40 * day), ago(2 * day)},
+		},
+		{
+			name:     "legacy backups only",
+			config:   PruneBackupsConfig{KeepLast: 2},
+			backups:  []Backup{incomplete(ago(3 * day)), incomplete(ago(2 * day)), incomplete(ago(day))},
+			expected: []int64{ago(3 * day)},
+		},
+		{
+			name:     "incomplete backups after a complete backup",
+			config:   PruneBackupsConfig{KeepLast: 1},
+			backups:  []Backup{complete(ago(5 * day)), incomplete(ago(4 * day)), incomplete(ago(time.Hour))},
+			expected: []int64{ago(4 * day)},
+		},
+		{
+			name:     "incomplete grace period",
+			config:   PruneBackupsConfig{KeepLast: 1, IncompleteGracePeriod: 5 * day},
+			backups:  []Backup{complete(ago(5 * day)), incomplete(ago(4 * day)), incomplete(ago(time.Hour))},
+			expected: nil,
+		},
+		{
+			name:     "parents of incremental backups",
+			config:   PruneBackupsConfig{KeepLast: 1},
+			backups:  []Backup{complete(ago(4 * day)), complete(ago(3 * day)), incremental(ago(2*day), ago(3*day)), incremental(ago(day), ago(2*day))},
+			expected: []int64{ago(4 * day)},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			prune := backupsToPrune(&tc.config, tc.backups, now)
+			if !reflect.DeepEqual(prune, tc.expected) {
+				t.Errorf("Pruned %v instead of %v", prune, tc.expected)
+			}
+		})
+	}
+}
+
+func TestPruneBackups(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	now := time.Now().Unix()
+	writeTestBackup(t, store, "index_1", now-3*86400, 0, true)
+	writeTestBackup(t, store, "index_1", now-2*86400, 0, true)
+	writeTestBackup(t, store, "index_1", now-86400, 0, true)
+	writeTestBackup(t, store, "chunks_1", now-3*86400, 0, true)
+
+	config := &PruneBackupsConfig{BackupPath: path, BigtableTableIDPrefix: "index_", KeepLast: 1, DryRun: true}
+	if err := PruneBackups(config); err != nil {
+		t.Fatal(err)
+	}
+	backups, err := ListBackups(&ListBackupConfig{BackupPath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups["index_1"]) != 3 {
+		t.Fatalf("Expected a dry run not to delete backups, got %+v", backups["index_1"])
+	}
+
+	config.DryRun = false
+	if err := PruneBackups(config); err != nil {
+		t.Fatal(err)
+	}
+	if backups, err = ListBackups(&ListBackupConfig{BackupPath: path}); err != nil {
+		t.Fatal(err)
+	}
+	if len(backups["index_1"]) != 1 || backups["index_1"][0].Timestamp != now-86400 {
+		t.Errorf("Expected the newest backup of index_1 to be kept, got %+v", backups["index_1"])
+	}
+	if len(backups["chunks_1"]) != 1 {
+		t.Errorf("Expected the backups of the tables without the prefix to be kept, got %+v", backups["chunks_1"])
+	}
+
+	if err := PruneBackups(&PruneBackupsConfig{BackupPath: path}); err == nil {
+		t.Error("Expected an error without retention policy")
+	}
+}
@@ -2,14 +2,15 @@ package backup
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"strings"
+	"os"
+	"time"
 
-	dataflowV1b3 "google.golang.org/api/dataflow/v1b3"
 	"gopkg.in/alecthomas/kingpin.v2"
-)
 
-const GCSSequenceFileToBigtableTemplatePath = "gs://dataflow-templates/latest/GCS_SequenceFile_to_Cloud_Bigtable"
+	bigtableAdminV2 "google.golang.org/api/bigtableadmin/v2"
+)
 
 // RestoreBackupConfig is the config for RestoreBackup command.
 type RestoreBackupConfig struct {
@@ -18,64 +19,207 @@ type RestoreBackupConfig struct {
 	BigtableInstanceID string
 	BigtableTableID    string
 	TempPrefix         string
+	JobLocation        string
 	BackupTimestamp    int64
+	Runner             string
+	LocalParallelism   int
+	CreateTable        bool
+	NoWait             bool
+	PushgatewayURL     string
+
+	// AsOf is an RFC3339 time to restore the newest backup made at or before, when BackupTimestamp is not set.
+	AsOf string
+
+	// Only the rows with keys starting with RowPrefix and in [StartKey, EndKey) are restored.
+	RowPrefix string
+	StartKey  string
+	EndKey    string
+
+	// The table the backup is restored to. They default to the project, instance and table of the backup.
+	TargetBigtableProjectID  string
+	TargetBigtableInstanceID string
+	TargetBigtableTableID    string
+
+	// JobRunner launches the import job. Defaults to the runner named by Runner.
+	JobRunner JobRunner
+	// JobStateCheckInterval is how often the states of the import jobs are polled. Defaults to 10 seconds.
+	JobStateCheckInterval time.Duration
 }
 
 // RegisterRestoreBackupsFlags registers the flags for RestoreBackup command.
 func RegisterRestoreBackupsFlags(cmd *kingpin.CmdClause) *RestoreBackupConfig {
 	config := RestoreBackupConfig{}
-	cmd.Flag("backup-path", "GCS path where backups can be found").Required().StringVar(&config.BackupPath)
+	cmd.Flag("backup-path", "Path where backups can be found. file:// paths are only supported by the local runner").Required().StringVar(&config.BackupPath)
 	cmd.Flag("bigtable-project-id", "The ID of the GCP project of the Cloud Bigtable instance that you want to read data from").Required().StringVar(&config.BigtableProjectID)
 	cmd.Flag("bigtable-instance-id", "The ID of the Cloud Bigtable instance that contains the table").Required().StringVar(&config.BigtableInstanceID)
 	cmd.Flag("bigtable-table-id", "ID of the Cloud Bigtable table to restore").Required().StringVar(&config.BigtableTableID)
-	cmd.Flag("temp-prefix", "Path and filename prefix for writing temporary files. ex: gs://MyBucket/tmp").Required().StringVar(&config.TempPrefix)
+	cmd.Flag("target-bigtable-project-id", "The ID of the GCP project of the Cloud Bigtable instance to restore to. Defaults to --bigtable-project-id, where the jobs run").StringVar(&config.TargetBigtableProjectID)
+	cmd.Flag("target-bigtable-instance-id", "The ID of the Cloud Bigtable instance to restore to. Defaults to --bigtable-instance-id").StringVar(&config.TargetBigtableInstanceID)
+	cmd.Flag("target-bigtable-table-id", "ID of the Cloud Bigtable table to restore to. Defaults to --bigtable-table-id").StringVar(&config.TargetBigtableTableID)
+	cmd.Flag("temp-prefix", "Path and filename prefix for writing temporary files. ex: gs://MyBucket/tmp. Required by the dataflow runner").StringVar(&config.TempPrefix)
+	cmd.Flag("job-location", "Location where we want to run the job e.g us-central1, europe-west1").Default("us-central1").StringVar(&config.JobLocation)
 	cmd.Flag("backup-timestamp", "Timestamp of the backup to be restored. If not set, most recent backup would be restored").Int64Var(&config.BackupTimestamp)
+	cmd.Flag("as-of", "Restore the most recent backup made at or before this time, in RFC3339 format e.g. 2019-05-20T14:05:00Z").StringVar(&config.AsOf)
+	cmd.Flag("runner", "Runner for the import job. Either dataflow or local, which imports the backup in-process").Default(dataflowRunner).EnumVar(&config.Runner, dataflowRunner, localRunner)
+	cmd.Flag("create-table", "Create the table with the schema saved in the backup. If the table exists, its schema must match the one of the backup").BoolVar(&config.CreateTable)
+	cmd.Flag("pushgateway-url", "URL of the Prometheus Pushgateway to push the metrics of the restore to").StringVar(&config.PushgatewayURL)
+	cmd.Flag("no-wait", "Return once the import job is created, without waiting for it to finish").BoolVar(&config.NoWait)
+	cmd.Flag("row-prefix", "Only restore the rows with keys starting with this prefix. Only supported by the local runner").StringVar(&config.RowPrefix)
+	cmd.Flag("start-key", "Only restore the rows with keys at or after this key. Only supported by the local runner").StringVar(&config.StartKey)
+	cmd.Flag("end-key", "Only restore the rows with keys before this key. Only supported by the local runner").StringVar(&config.EndKey)
+	cmd.Flag("local-parallelism", "Maximum number of concurrent MutateRows requests of the local runner").Default("8").IntVar(&config.LocalParallelism)
 
 	return &config
 }
 
 // RestoreBackup restores the backups.
 func RestoreBackup(config *RestoreBackupConfig) error {
+	partial := config.RowPrefix != "" || config.StartKey != "" || config.EndKey != ""
+	if partial && config.JobRunner == nil && config.Runner != localRunner {
+		return errors.New("Partial restores are only supported by the local runner")
+	}
+	if config.StartKey != "" && config.EndKey != "" && config.StartKey >= config.EndKey {
+		return fmt.Errorf("Start key %q must be before end key %q", config.StartKey, config.EndKey)
+	}
+
+	var asOf time.Time
+	if config.AsOf != "" {
+		if config.BackupTimestamp != 0 {
+			return errors.New("Only one of --backup-timestamp and --as-of can be set")
+		}
+
+		var err error
+		if asOf, err = time.Parse(time.RFC3339, config.AsOf); err != nil {
+			return fmt.Errorf("Invalid --as-of time %s with error: %s", config.AsOf, err)
+		}
+	}
+
 	if config.BackupTimestamp == 0 {
-		backupTimestamp, err := getNewestBackupTimestamp(config.BackupPath, config.BigtableTableID)
+		backupTimestamp, err := getNewestBackupTimestamp(config.BackupPath, config.BigtableTableID, asOf)
 		if err != nil {
 			return err
 		}
 		config.BackupTimestamp = *backupTimestamp
-		fmt.Printf("Newest backup for %s is for timestamp %d\n", config.BigtableTableID, config.BackupTimestamp)
+		if asOf.IsZero() {
+			fmt.Printf("Newest backup for %s is for timestamp %d\n", config.BigtableTableID, config.BackupTimestamp)
+		} else {
+			fmt.Printf("Newest backup for %s as of %s is for timestamp %d\n", config.BigtableTableID, config.AsOf, config.BackupTimestamp)
+		}
 	}
 
-	if !strings.HasPrefix(config.BackupPath, "gs://") {
-		config.BackupPath = "gs://" + config.BackupPath
+	if config.TargetBigtableProjectID == "" {
+		config.TargetBigtableProjectID = config.BigtableProjectID
 	}
-
-	if strings.HasSuffix(config.BackupPath, "/") {
-		config.BackupPath = config.BackupPath[0 : len(config.BackupPath)-1]
+	if config.TargetBigtableInstanceID == "" {
+		config.TargetBigtableInstanceID = config.BigtableInstanceID
+	}
+	if config.TargetBigtableTableID == "" {
+		config.TargetBigtableTableID = config.BigtableTableID
 	}
 
 	ctx := context.Background()
-	service, err := dataflowV1b3.NewService(ctx)
+	store, err := NewBackupStore(ctx, config.BackupPath)
+	if err != nil {
+		return err
+	}
+
+	if config.CreateTable {
+		manifest, err := readManifest(ctx, store, config.BigtableTableID, config.BackupTimestamp)
+		if err != nil {
+			return err
+		}
+		if manifest == nil {
+			return fmt.Errorf("Backup of table %s with timestamp %d has no manifest with the schema of the table", config.BigtableTableID, config.BackupTimestamp)
+		}
+
+		err = createTable(ctx, config.TargetBigtableProjectID, config.TargetBigtableInstanceID, config.TargetBigtableTableID, &bigtableAdminV2.Table{
+			ColumnFamilies: manifest.ColumnFamilies,
+			Granularity:    manifest.Granularity,
+		})
+		if err != nil {
+			return fmt.Errorf("Error creating table %s with error: %s", config.TargetBigtableTableID, err)
+		}
+	}
+
+	runner := config.JobRunner
+	if runner == nil {
+		runner, err = newJobRunner(ctx, config.Runner, config.BigtableProjectID, config.JobLocation, config.TempPrefix)
+		if err != nil {
+			return err
+		}
+	}
+	if localJobRunner, ok := runner.(*LocalJobRunner); ok && config.LocalParallelism > 0 {
+		localJobRunner.ImportParallelism = config.LocalParallelism
+	}
+
+	chain, err := backupChain(ctx, store, config.BigtableTableID, config.BackupTimestamp)
 	if err != nil {
 		return err
 	}
+	if len(chain) > 1 {
+		fmt.Printf("Backup of %s with timestamp %d is incremental, restoring the backups with timestamps %v in order\n", config.BigtableTableID, config.BackupTimestamp, chain)
+	}
+
+	defer pushMetrics(config.PushgatewayURL, map[string]string{"command": "restore", "table": config.TargetBigtableTableID})
+
+	// The backups of the chain are imported one after the other, so that the newer cells overwrite the older ones.
+	for i, timestamp := range chain {
+		launched := time.Now()
+		jobID, err := runner.LaunchImport(ctx, &ImportJob{
+			Name:               fmt.Sprintf("import-%s-%d", config.TargetBigtableTableID, timestamp),
+			BigtableProjectID:  config.TargetBigtableProjectID,
+			BigtableInstanceID: config.TargetBigtableInstanceID,
+			BigtableTableID:    config.TargetBigtableTableID,
+			SourcePath:         store.URL(fmt.Sprintf("%s/%d/", config.BigtableTableID, timestamp)),
+			FilenamePrefix:     config.BigtableTableID + bigtableIDSeparatorInSeqFileName,
+			RowPrefix:          config.RowPrefix,
+			StartKey:           config.StartKey,
+			EndKey:             config.EndKey,
+		})
+		if err != nil {
+			recordJobFailure(importJobType, "")
+			return fmt.Errorf("Error restoring backup of table with Id %s with error: %s", config.BigtableTableID, err)
+		}
+		fmt.Printf("Created job for restoring %s with timestamp %d to %s/%s/%s\n", config.BigtableTableID, timestamp,
+			config.TargetBigtableProjectID, config.TargetBigtableInstanceID, config.TargetBigtableTableID)
 
-	jobName := fmt.Sprintf("import-%s-%d", config.BigtableTableID, config.BackupTimestamp)
-	restoreJobFromTemplateRequest := dataflowV1b3.CreateJobFromTemplateRequest{
-		JobName: jobName,
-		GcsPath: GCSSequenceFileToBigtableTemplatePath,
-		Parameters: map[string]string{
-			"bigtableProject":    config.BigtableProjectID,
-			"bigtableInstanceId": config.BigtableInstanceID,
-			"bigtableTableId":    config.BigtableTableID,
-			"sourcePattern":      fmt.Sprintf("%s/%s/%d/%s%s*", config.BackupPath, config.BigtableTableID, config.BackupTimestamp, config.BigtableTableID, bigtableIDSeparatorInSeqFileName),
-		},
-		Environment: &dataflowV1b3.RuntimeEnvironment{
-			TempLocation: config.TempPrefix,
-		},
+		if config.NoWait && i == len(chain)-1 {
+			return nil
+		}
+
+		if state, err := waitForJob(ctx, runner, jobID, config.JobStateCheckInterval, os.Stdout); err != nil {
+			recordJobFailure(importJobType, state)
+			return err
+		}
+		jobDuration.WithLabelValues(importJobType).Observe(time.Since(launched).Seconds())
+		fmt.Printf("Job for restoring %s with timestamp %d finished\n", config.BigtableTableID, timestamp)
 	}
 
-	_, err = service.Projects.Templates.Create(config.BigtableProjectID, &restoreJobFromTemplateRequest).Do()
-	fmt.Printf("Created job for restoring %s with timestamp %d\n", config.BigtableTableID, config.BackupTimestamp)
+	return nil
+}
+
+// backupChain returns the timestamps of the backups to restore in order to restore a backup: the full backup
+// followed by the incremental backups made since it, ending with the backup itself.
+func backupChain(ctx context.Context, store BackupStore, tableID string, timestamp int64) ([]int64, error) {
+	chain := []int64{timestamp}
+	manifest, err := readManifest(ctx, store, tableID, timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	for manifest != nil && manifest.Parent != 0 {
+		parent := manifest.Parent
+		if parent >= chain[0] {
+			return nil, fmt.Errorf("Backup of table %s with timestamp %d has parent %d which is not older", tableID, chain[0], parent)
+		}
+		if manifest, err = readManifest(ctx, store, tableID, parent); err != nil {
+			return nil, err
+		}
+		if manifest == nil {
+			return nil, fmt.Errorf("Parent backup of table %s with timestamp %d is missing or incomplete", tableID, parent)
+		}
+		chain = append([]int64{parent}, chain...)
+	}
 
-	return err
+	return chain, nil
 }
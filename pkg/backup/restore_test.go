@@ -0,0 +1,252 @@
+package backup
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRestoreBackup(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	writeTestBackup(t, store, "index_1", 100, 0, true)
+	writeTestBackup(t, store, "index_1", 200, 100, true)
+	writeTestBackup(t, store, "index_1", 300, 0, false)
+
+	for _, tc := range []struct {
+		name            string
+		backupTimestamp int64
+		asOf            string
+		expectedSources []string
+	}{
+		{
+			name:            "newest complete backup with its parent",
+			expectedSources: []string{store.URL("index_1/100/"), store.URL("index_1/200/")},
+		},
+		{
+			name:            "as of a time",
+			asOf:            time.Unix(150, 0).UTC().Format(time.RFC3339),
+			expectedSources: []string{store.URL("index_1/100/")},
+		},
+		{
+			name:            "backup timestamp",
+			backupTimestamp: 100,
+			expectedSources: []string{store.URL("index_1/100/")},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			runner := NewFakeJobRunner()
+			err := RestoreBackup(&RestoreBackupConfig{
+				BackupPath:            path,
+				BigtableProjectID:     "project",
+				BigtableInstanceID:    "instance",
+				BigtableTableID:       "index_1",
+				TargetBigtableTableID: "restored",
+				BackupTimestamp:       tc.backupTimestamp,
+				AsOf:                  tc.asOf,
+				JobRunner:             runner,
+				JobStateCheckInterval: time.Millisecond,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var sources []string
+			for _, job := range runner.ImportJobs() {
+				sources = append(sources, job.SourcePath)
+				if job.BigtableProjectID != "project" || job.BigtableTableID != "restored" || job.FilenamePrefix != "index_1:" {
+					t.Errorf("Unexpected import job %+v", job)
+				}
+			}
+			if !reflect.DeepEqual(sources, tc.expectedSources) {
+				t.Errorf("Imported %v instead of %v", sources, tc.expectedSources)
+			}
+		})
+	}
+}
+
+func TestRestoreBackupFailure(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	writeTestBackup(t, store, "index_1", 100, 0, true)
+	writeTestBackup(t, store, "index_1", 200, 100, true)
+
+	runner := NewFakeJobRunner()
+	runner.JobStates["index_1"] = []JobState{JobStateRunning, JobStateCancelled}
+	err := RestoreBackup(&RestoreBackupConfig{
+		BackupPath:            path,
+		BigtableTableID:       "index_1",
+		JobRunner:             runner,
+		JobStateCheckInterval: time.Millisecond,
+	})
+	if err == nil {
+		t.Fatal("Expected the restore to fail")
+	}
+
+	// The incremental backup is not imported once the import of its parent failed.
+	if jobs := runner.ImportJobs(); len(jobs) != 1 || jobs[0].SourcePath != store.URL("index_1/100/") {
+		t.Errorf("Unexpected import jobs %+v", jobs)
+	}
+}
+
+func TestRestoreBackupNoCompleteBackup(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	writeTestBackup(t, store, "index_1", 100, 0, false)
+	writeTestBackup(t, store, "index_1", 200, 0, true)
+
+	runner := NewFakeJobRunner()
+	err := RestoreBackup(&RestoreBackupConfig{
+		BackupPath:      path,
+		BigtableTableID: "index_1",
+		AsOf:            time.Unix(150, 0).UTC().Format(time.RFC3339),
+		JobRunner:       runner,
+	})
+	if err == nil || err.Error() != "No complete backups found at or before "+time.Unix(150, 0).Format(time.RFC3339) {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if jobs := runner.ImportJobs(); len(jobs) != 0 {
+		t.Errorf("Unexpected import jobs %+v", jobs)
+	}
+}
+
+func TestRestoreBackupWithoutManifests(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	// The backups of a bucket written before manifests.
+	writeTestBackup(t, store, "index_1", 100, 0, false)
+	writeTestBackup(t, store, "index_1", 200, 0, false)
+
+	runner := NewFakeJobRunner()
+	err := RestoreBackup(&RestoreBackupConfig{
+		BackupPath:            path,
+		BigtableTableID:       "index_1",
+		JobRunner:             runner,
+		JobStateCheckInterval: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jobs := runner.ImportJobs(); len(jobs) != 1 || jobs[0].SourcePath != store.URL("index_1/200/") {
+		t.Errorf("Unexpected import jobs %+v", jobs)
+	}
+}
+
+func TestRestoreBackupRowRange(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	writeTestBackup(t, store, "index_1", 100, 0, true)
+
+	for _, tc := range []struct {
+		name                  string
+		rowPrefix, start, end string
+		err                   string
+	}{
+		{name: "prefix", rowPrefix: "user:"},
+		{name: "start key", start: "b"},
+		{name: "end key", end: "b"},
+		{name: "prefix and key range", rowPrefix: "user:", start: "user:2", end: "user:4"},
+		{name: "start key equal to the end key", start: "b", end: "b", err: `Start key "b" must be before end key "b"`},
+		{name: "start key after the end key", start: "c", end: "b", err: `Start key "c" must be before end key "b"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			runner := NewFakeJobRunner()
+			err := RestoreBackup(&RestoreBackupConfig{
+				BackupPath:            path,
+				BigtableTableID:       "index_1",
+				RowPrefix:             tc.rowPrefix,
+				StartKey:              tc.start,
+				EndKey:                tc.end,
+				JobRunner:             runner,
+				JobStateCheckInterval: time.Millisecond,
+			})
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("Expected error %q, got %v", tc.err, err)
+				}
+				if jobs := runner.ImportJobs(); len(jobs) != 0 {
+					t.Errorf("Unexpected import jobs %+v", jobs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			jobs := runner.ImportJobs()
+			if len(jobs) != 1 || jobs[0].RowPrefix != tc.rowPrefix || jobs[0].StartKey != tc.start || jobs[0].EndKey != tc.end {
+				t.Errorf("Unexpected import jobs %+v", jobs)
+			}
+		})
+	}
+
+	err := RestoreBackup(&RestoreBackupConfig{BackupPath: path, BigtableTableID: "index_1", RowPrefix: "user:", Runner: dataflowRunner})
+	if err == nil || err.Error() != "Partial restores are only supported by the local runner" {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestRestoreBackupNoWait(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	writeTestBackup(t, store, "index_1", 100, 0, true)
+	writeTestBackup(t, store, "index_1", 200, 100, true)
+
+	for _, tc := range []struct {
+		name            string
+		backupTimestamp int64
+		expectedSources []string
+	}{
+		{
+			name:            "full backup",
+			backupTimestamp: 100,
+			expectedSources: []string{store.URL("index_1/100/")},
+		},
+		{
+			name:            "chain of backups",
+			backupTimestamp: 200,
+			expectedSources: []string{store.URL("index_1/100/"), store.URL("index_1/200/")},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			runner := NewFakeJobRunner()
+			err := RestoreBackup(&RestoreBackupConfig{
+				BackupPath:            path,
+				BigtableTableID:       "index_1",
+				BackupTimestamp:       tc.backupTimestamp,
+				NoWait:                true,
+				JobRunner:             runner,
+				JobStateCheckInterval: time.Millisecond,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			jobs := runner.ImportJobs()
+			var sources []string
+			for _, job := range jobs {
+				sources = append(sources, job.SourcePath)
+			}
+			if !reflect.DeepEqual(sources, tc.expectedSources) {
+				t.Fatalf("Imported %v instead of %v", sources, tc.expectedSources)
+			}
+
+			// The imports of the chain before the last one must be done before the next one starts.
+			for i := range jobs {
+				polls := runner.Polls(fmt.Sprintf("fake-job-%d", i))
+				if last := i == len(jobs)-1; last && polls != 0 {
+					t.Errorf("Polled the state of the last import job %d times", polls)
+				} else if !last && polls == 0 {
+					t.Errorf("Did not wait for the import job %d", i)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// JobState is the state of a job launched by a JobRunner.
+// The states are the ones of Dataflow jobs.
+type JobState string
+
+// The states of a job.
+const (
+	JobStateUnknown    JobState = "JOB_STATE_UNKNOWN"
+	JobStatePending    JobState = "JOB_STATE_PENDING"
+	JobStateRunning    JobState = "JOB_STATE_RUNNING"
+	JobStateDone       JobState = "JOB_STATE_DONE"
+	JobStateFailed     JobState = "JOB_STATE_FAILED"
+	JobStateCancelled  JobState = "JOB_STATE_CANCELLED"
+	JobStateCancelling JobState = "JOB_STATE_CANCELLING"
+)
+
+var jobFailureStates = map[JobState]struct{}{JobStateFailed: {}, JobStateCancelled: {}, JobStateCancelling: {}}
+
+// ExportJob describes a job exporting a Bigtable table to SequenceFiles.
+type ExportJob struct {
+	Name               string
+	BigtableProjectID  string
+	BigtableInstanceID string
+	BigtableTableID    string
+	// DestinationPath is the URL of the directory where the SequenceFiles are written, ending with "/".
+	DestinationPath string
+	FilenamePrefix  string
+	// StartTime makes the job only export the cells with a timestamp at or after it. Zero exports all the cells.
+	StartTime time.Time
+}
+
+// ImportJob describes a job importing SequenceFiles to a Bigtable table.
+type ImportJob struct {
+	Name               string
+	BigtableProjectID  string
+	BigtableInstanceID string
+	BigtableTableID    string
+	// SourcePath is the URL of the directory with the SequenceFiles, ending with "/".
+	SourcePath     string
+	FilenamePrefix string
+
+	// The job only imports the rows with keys starting with RowPrefix and in [StartKey, EndKey).
+	// Empty values do not filter the rows.
+	RowPrefix string
+	StartKey  string
+	EndKey    string
+}
+
+// partial returns whether the job only imports some of the rows.
+func (j *ImportJob) partial() bool {
+	return j.RowPrefix != "" || j.StartKey != "" || j.EndKey != ""
+}
+
+// includesRow returns whether the job imports the row with the given key.
+func (j *ImportJob) includesRow(rowKey []byte) bool {
+	if !bytes.HasPrefix(rowKey, []byte(j.RowPrefix)) {
+		return false
+	}
+	if j.StartKey != "" && bytes.Compare(rowKey, []byte(j.StartKey)) < 0 {
+		return false
+	}
+	return j.EndKey == "" || bytes.Compare(rowKey, []byte(j.EndKey)) < 0
+}
+
+// JobRunner launches and tracks the jobs which export and import the tables.
+type JobRunner interface {
+	LaunchExport(ctx context.Context, job *ExportJob) (jobID string, err error)
+	LaunchImport(ctx context.Context, job *ImportJob) (jobID string, err error)
+	GetJobState(ctx context.Context, jobID string) (JobState, error)
+	CancelJob(ctx context.Context, jobID string) error
+}
+
+// Names of the supported job runners.
+const (
+	dataflowRunner = "dataflow"
+	localRunner    = "local"
+)
+
+// newJobRunner creates the job runner with the given name.
+func newJobRunner(ctx context.Context, name, projectID, location, tempPrefix string) (JobRunner, error) {
+	switch name {
+	case localRunner:
+		return NewLocalJobRunner(), nil
+	case dataflowRunner, "":
+		if tempPrefix == "" {
+			return nil, errors.New("Temp prefix is required by the dataflow runner")
+		}
+		return NewDataflowJobRunner(ctx, projectID, location, tempPrefix)
+	default:
+		return nil, fmt.Errorf("Unknown job runner %s", name)
+	}
+}
+
+// waitForJob polls the state of the job every interval until it is done or fails, and returns its final state.
+// A zero interval polls every 10 seconds. The states of the running job are printed to w.
+func waitForJob(ctx context.Context, runner JobRunner, jobID string, interval time.Duration, w io.Writer) (JobState, error) {
+	if interval <= 0 {
+		interval = jobStateCheckDuration
+	}
+
+	for {
+		state, err := runner.GetJobState(ctx, jobID)
+		if err != nil {
+			return JobStateUnknown, fmt.Errorf("Error getting state of the job with Id %s with error: %s", jobID, err)
+		}
+
+		if _, isFailure := jobFailureStates[state]; isFailure {
+			return state, fmt.Errorf("Job with Id %s failed with state %s", jobID, state)
+		}
+		if state == JobStateDone {
+			return state, nil
+		}
+
+		fmt.Fprintf(w, "Current state of job with Id %s: %s\n", jobID, state)
+
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,65 @@
+package backup
+
+import "testing"
+
+func TestImportJobIncludesRow(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		job      ImportJob
+		included []string
+		excluded []string
+	}{
+		{
+			name:     "all the rows",
+			included: []string{"", "a", "\xff"},
+		},
+		{
+			name:     "prefix",
+			job:      ImportJob{RowPrefix: "user:1"},
+			included: []string{"user:1", "user:1:a", "user:10"},
+			excluded: []string{"", "user:", "user:2", "user", "a:user:1"},
+		},
+		{
+			name:     "inclusive start key",
+			job:      ImportJob{StartKey: "b"},
+			included: []string{"b", "b\x00", "c"},
+			excluded: []string{"", "a", "a\xff"},
+		},
+		{
+			name:     "exclusive end key",
+			job:      ImportJob{EndKey: "b"},
+			included: []string{"", "a", "a\xff"},
+			excluded: []string{"b", "b\x00", "c"},
+		},
+		{
+			name:     "key range",
+			job:      ImportJob{StartKey: "b", EndKey: "d"},
+			included: []string{"b", "c", "c\xff"},
+			excluded: []string{"a", "d", "e"},
+		},
+		{
+			name:     "prefix and key range",
+			job:      ImportJob{RowPrefix: "user:", StartKey: "user:2", EndKey: "user:4"},
+			included: []string{"user:2", "user:3", "user:3:a"},
+			excluded: []string{"user:1", "user:4", "user:5", "a", "user"},
+		},
+		{
+			name:     "key range outside of the prefix",
+			job:      ImportJob{RowPrefix: "user:", StartKey: "a", EndKey: "b"},
+			excluded: []string{"a", "a:user:", "user:1"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, rowKey := range tc.included {
+				if !tc.job.includesRow([]byte(rowKey)) {
+					t.Errorf("Expected row %q to be imported", rowKey)
+				}
+			}
+			for _, rowKey := range tc.excluded {
+				if tc.job.includesRow([]byte(rowKey)) {
+					t.Errorf("Expected row %q not to be imported", rowKey)
+				}
+			}
+		})
+	}
+}
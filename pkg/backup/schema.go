@@ -0,0 +1,271 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	bigtableAdminV2 "google.golang.org/api/bigtableadmin/v2"
+	btapb "google.golang.org/genproto/googleapis/bigtable/admin/v2"
+)
+
+// TableAdmin looks up the tables of a Bigtable instance and their schemas.
+type TableAdmin interface {
+	// ListTables returns the IDs of all the tables of the instance.
+	ListTables(ctx context.Context) ([]string, error)
+	// GetTableSchema returns the column families of a table with their GC rules, and the granularity of the table.
+	GetTableSchema(ctx context.Context, tableID string) (*bigtableAdminV2.Table, error)
+}
+
+// adminAPI is the TableAdmin of an instance which uses the Bigtable admin API.
+type adminAPI struct {
+	projectID  string
+	instanceID string
+	// opts are the options of the client of the admin API, only set by tests.
+	opts []option.ClientOption
+}
+
+func newTableAdmin(projectID, instanceID string) TableAdmin {
+	return &adminAPI{projectID: projectID, instanceID: instanceID}
+}
+
+func (a *adminAPI) ListTables(ctx context.Context) ([]string, error) {
+	// The emulator only serves the gRPC API.
+	if os.Getenv("BIGTABLE_EMULATOR_HOST") != "" {
+		adminClient, err := bigtable.NewAdminClient(ctx, a.projectID, a.instanceID)
+		if err != nil {
+			return nil, err
+		}
+		defer adminClient.Close()
+
+		return adminClient.Tables(ctx)
+	}
+
+	service, err := bigtableAdminV2.NewService(ctx, a.opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the names of the tables are needed, which is the default NAME_ONLY view.
+	parent := "projects/" + a.projectID + "/instances/" + a.instanceID
+	var tableIDs []string
+	err = service.Projects.Instances.Tables.List(parent).Pages(ctx, func(page *bigtableAdminV2.ListTablesResponse) error {
+		for _, table := range page.Tables {
+			tableIDs = append(tableIDs, table.Name[strings.LastIndex(table.Name, "/")+1:])
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return tableIDs, nil
+}
+
+func (a *adminAPI) GetTableSchema(ctx context.Context, tableID string) (*bigtableAdminV2.Table, error) {
+	return getTableSchema(ctx, a.projectID, a.instanceID, tableID)
+}
+
+// getTableSchema returns the column families of a table with their GC rules, and the granularity of the table.
+func getTableSchema(ctx context.Context, projectID, instanceID, tableID string) (*bigtableAdminV2.Table, error) {
+	name := "projects/" + projectID + "/instances/" + instanceID + "/tables/" + tableID
+
+	// The emulator only serves the gRPC API.
+	if emulatorHost := os.Getenv("BIGTABLE_EMULATOR_HOST"); emulatorHost != "" {
+		conn, err := grpc.Dial(emulatorHost, grpc.WithInsecure())
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+
+		table, err := btapb.NewBigtableTableAdminClient(conn).GetTable(ctx, &btapb.GetTableRequest{Name: name, View: btapb.Table_SCHEMA_VIEW})
+		if err != nil {
+			return nil, err
+		}
+
+		columnFamilies := make(map[string]bigtableAdminV2.ColumnFamily, len(table.ColumnFamilies))
+		for family, columnFamily := range table.ColumnFamilies {
+			columnFamilies[family] = bigtableAdminV2.ColumnFamily{GcRule: gcRuleFromProto(columnFamily.GcRule)}
+		}
+		return &bigtableAdminV2.Table{ColumnFamilies: columnFamilies}, nil
+	}
+
+	service, err := bigtableAdminV2.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return service.Projects.Instances.Tables.Get(name).View("SCHEMA_VIEW").Context(ctx).Do()
+}
+
+// gcRuleFromProto converts a GC rule returned by the gRPC API to the one of the REST API.
+func gcRuleFromProto(rule *btapb.GcRule) *bigtableAdminV2.GcRule {
+	switch r := rule.GetRule().(type) {
+	case *btapb.GcRule_MaxNumVersions:
+		return &bigtableAdminV2.GcRule{MaxNumVersions: int64(r.MaxNumVersions)}
+	case *btapb.GcRule_MaxAge:
+		maxAge := time.Duration(r.MaxAge.Seconds)*time.Second + time.Duration(r.MaxAge.Nanos)
+		return &bigtableAdminV2.GcRule{MaxAge: strconv.FormatFloat(maxAge.Seconds(), 'f', -1, 64) + "s"}
+	case *btapb.GcRule_Intersection_:
+		return &bigtableAdminV2.GcRule{Intersection: &bigtableAdminV2.Intersection{Rules: gcRulesFromProto(r.Intersection.Rules)}}
+	case *btapb.GcRule_Union_:
+		return &bigtableAdminV2.GcRule{Union: &bigtableAdminV2.Union{Rules: gcRulesFromProto(r.Union.Rules)}}
+	default:
+		return nil
+	}
+}
+
+func gcRulesFromProto(rules []*btapb.GcRule) []*bigtableAdminV2.GcRule {
+	converted := make([]*bigtableAdminV2.GcRule, 0, len(rules))
+	for _, rule := range rules {
+		converted = append(converted, gcRuleFromProto(rule))
+	}
+	return converted
+}
+
+// createTable creates a table with the schema saved in a backup. If the table
+// already exists, it checks that its column families and GC rules match the schema.
+func createTable(ctx context.Context, projectID, instanceID, tableID string, schema *bigtableAdminV2.Table) error {
+	expectedPolicies, err := gcPolicies(schema.ColumnFamilies)
+	if err != nil {
+		return err
+	}
+
+	if os.Getenv("BIGTABLE_EMULATOR_HOST") != "" {
+		adminClient, err := bigtable.NewAdminClient(ctx, projectID, instanceID)
+		if err != nil {
+			return err
+		}
+		defer adminClient.Close()
+
+		families := make(map[string]bigtable.GCPolicy, len(schema.ColumnFamilies))
+		for family, columnFamily := range schema.ColumnFamilies {
+			if families[family], err = gcRuleToPolicy(columnFamily.GcRule); err != nil {
+				return err
+			}
+		}
+
+		err = adminClient.CreateTableFromConf(ctx, &bigtable.TableConf{TableID: tableID, Families: families})
+		if status.Code(err) != codes.AlreadyExists {
+			return err
+		}
+	} else {
+		service, err := bigtableAdminV2.NewService(ctx)
+		if err != nil {
+			return err
+		}
+
+		parent := "projects/" + projectID + "/instances/" + instanceID
+		_, err = service.Projects.Instances.Tables.Create(parent, &bigtableAdminV2.CreateTableRequest{
+			TableId: tableID,
+			Table: &bigtableAdminV2.Table{
+				ColumnFamilies: schema.ColumnFamilies,
+				Granularity:    schema.Granularity,
+			},
+		}).Context(ctx).Do()
+		if apiErr, ok := err.(*googleapi.Error); !ok || apiErr.Code != http.StatusConflict {
+			return err
+		}
+	}
+
+	table, err := getTableSchema(ctx, projectID, instanceID, tableID)
+	if err != nil {
+		return err
+	}
+	policies, err := gcPolicies(table.ColumnFamilies)
+	if err != nil {
+		return err
+	}
+	return checkGCPolicies(tableID, expectedPolicies, policies)
+}
+
+// gcPolicies returns the GC rules of the column families in the format of bigtable.GCPolicy.String.
+func gcPolicies(columnFamilies map[string]bigtableAdminV2.ColumnFamily) (map[string]string, error) {
+	policies := make(map[string]string, len(columnFamilies))
+	for family, columnFamily := range columnFamilies {
+		policy, err := gcRuleToPolicy(columnFamily.GcRule)
+		if err != nil {
+			return nil, err
+		}
+		policies[family] = policy.String()
+	}
+	return policies, nil
+}
+
+func gcRuleToPolicy(rule *bigtableAdminV2.GcRule) (bigtable.GCPolicy, error) {
+	switch {
+	case rule == nil:
+		return bigtable.NoGcPolicy(), nil
+	case rule.MaxNumVersions != 0:
+		return bigtable.MaxVersionsPolicy(int(rule.MaxNumVersions)), nil
+	case rule.MaxAge != "":
+		maxAge, err := time.ParseDuration(rule.MaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid max age %s of GC rule with error: %s", rule.MaxAge, err)
+		}
+		return bigtable.MaxAgePolicy(maxAge), nil
+	case rule.Intersection != nil:
+		policies, err := gcRulesToPolicies(rule.Intersection.Rules)
+		if err != nil {
+			return nil, err
+		}
+		return bigtable.IntersectionPolicy(policies...), nil
+	case rule.Union != nil:
+		policies, err := gcRulesToPolicies(rule.Union.Rules)
+		if err != nil {
+			return nil, err
+		}
+		return bigtable.UnionPolicy(policies...), nil
+	default:
+		return bigtable.NoGcPolicy(), nil
+	}
+}
+
+func gcRulesToPolicies(rules []*bigtableAdminV2.GcRule) ([]bigtable.GCPolicy, error) {
+	policies := make([]bigtable.GCPolicy, 0, len(rules))
+	for _, rule := range rules {
+		policy, err := gcRuleToPolicy(rule)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+// checkGCPolicies returns an error listing the differences between the expected and the actual column families of a table.
+func checkGCPolicies(tableID string, expected, actual map[string]string) error {
+	var mismatches []string
+	for family, policy := range expected {
+		actualPolicy, ok := actual[family]
+		switch {
+		case !ok:
+			mismatches = append(mismatches, fmt.Sprintf("column family %s is missing", family))
+		case actualPolicy != policy:
+			mismatches = append(mismatches, fmt.Sprintf("column family %s has GC rule %q instead of %q", family, actualPolicy, policy))
+		}
+	}
+	for family := range actual {
+		if _, ok := expected[family]; !ok {
+			mismatches = append(mismatches, fmt.Sprintf("column family %s is not in the backup", family))
+		}
+	}
+
+	if len(mismatches) == 0 {
+		return nil
+	}
+	sort.Strings(mismatches)
+	return fmt.Errorf("Table %s already exists with a different schema: %s", tableID, strings.Join(mismatches, ", "))
+}
@@ -0,0 +1,232 @@
+package backup
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	durpb "github.com/golang/protobuf/ptypes/duration"
+	bigtableAdminV2 "google.golang.org/api/bigtableadmin/v2"
+	"google.golang.org/api/option"
+	btapb "google.golang.org/genproto/googleapis/bigtable/admin/v2"
+)
+
+func TestGcRuleFromProto(t *testing.T) {
+	maxAge := func(seconds int64, nanos int32) *btapb.GcRule {
+		return &btapb.GcRule{Rule: &btapb.GcRule_MaxAge{MaxAge: &durpb.Duration{Seconds: seconds, Nanos: nanos}}}
+	}
+	maxVersions := func(versions int32) *btapb.GcRule {
+		return &btapb.GcRule{Rule: &btapb.GcRule_MaxNumVersions{MaxNumVersions: versions}}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		rule     *btapb.GcRule
+		expected *bigtableAdminV2.GcRule
+	}{
+		{
+			name: "no rule",
+		},
+		{
+			name:     "max versions",
+			rule:     maxVersions(3),
+			expected: &bigtableAdminV2.GcRule{MaxNumVersions: 3},
+		},
+		{
+			name:     "max age in days",
+			rule:     maxAge(7*24*3600, 0),
+			expected: &bigtableAdminV2.GcRule{MaxAge: "604800s"},
+		},
+		{
+			name:     "max age with nanoseconds",
+			rule:     maxAge(1, 500000000),
+			expected: &bigtableAdminV2.GcRule{MaxAge: "1.5s"},
+		},
+		{
+			name: "union of an intersection",
+			rule: &btapb.GcRule{Rule: &btapb.GcRule_Union_{Union: &btapb.GcRule_Union{Rules: []*btapb.GcRule{
+				maxVersions(10),
+				{Rule: &btapb.GcRule_Intersection_{Intersection: &btapb.GcRule_Intersection{Rules: []*btapb.GcRule{
+					maxAge(3600, 0),
+					maxVersions(1),
+				}}}},
+			}}}},
+			expected: &bigtableAdminV2.GcRule{Union: &bigtableAdminV2.Union{Rules: []*bigtableAdminV2.GcRule{
+				{MaxNumVersions: 10},
+				{Intersection: &bigtableAdminV2.Intersection{Rules: []*bigtableAdminV2.GcRule{
+					{MaxAge: "3600s"},
+					{MaxNumVersions: 1},
+				}}},
+			}}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := gcRuleFromProto(tc.rule); !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("Converted to %+v instead of %+v", actual, tc.expected)
+			}
+		})
+	}
+}
+
+func TestGcRuleToPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		rule     *bigtableAdminV2.GcRule
+		expected string
+		err      bool
+	}{
+		{name: "no rule", expected: ""},
+		{name: "empty rule", rule: &bigtableAdminV2.GcRule{}, expected: ""},
+		{name: "max versions", rule: &bigtableAdminV2.GcRule{MaxNumVersions: 3}, expected: "versions() > 3"},
+		{name: "max age in days", rule: &bigtableAdminV2.GcRule{MaxAge: "604800s"}, expected: "age() > 7d"},
+		{name: "max age in hours", rule: &bigtableAdminV2.GcRule{MaxAge: "3600s"}, expected: "age() > 1h"},
+		{name: "max age with a fraction of second", rule: &bigtableAdminV2.GcRule{MaxAge: "1.5s"}, expected: "age() > 1500000"},
+		{name: "invalid max age", rule: &bigtableAdminV2.GcRule{MaxAge: "1 week"}, err: true},
+		{
+			name: "union of an intersection",
+			rule: &bigtableAdminV2.GcRule{Union: &bigtableAdminV2.Union{Rules: []*bigtableAdminV2.GcRule{
+				{MaxNumVersions: 10},
+				{Intersection: &bigtableAdminV2.Intersection{Rules: []*bigtableAdminV2.GcRule{
+					{MaxAge: "3600s"},
+					{MaxNumVersions: 1},
+				}}},
+			}}},
+			expected: "(versions() > 10 || (age() > 1h && versions() > 1))",
+		},
+		{
+			name: "invalid nested max age",
+			rule: &bigtableAdminV2.GcRule{Intersection: &bigtableAdminV2.Intersection{Rules: []*bigtableAdminV2.GcRule{
+				{MaxNumVersions: 1},
+				{Union: &bigtableAdminV2.Union{Rules: []*bigtableAdminV2.GcRule{{MaxAge: "-"}}}},
+			}}},
+			err: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			policy, err := gcRuleToPolicy(tc.rule)
+			if tc.err {
+				if err == nil {
+					t.Errorf("Expected an error, got policy %s", policy)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if policy.String() != tc.expected {
+				t.Errorf("Converted to %q instead of %q", policy.String(), tc.expected)
+			}
+		})
+	}
+}
+
+func TestCheckGCPolicies(t *testing.T) {
+	expected := map[string]string{"a": "versions() > 1", "b": "age() > 7d"}
+	for _, tc := range []struct {
+		name   string
+		actual map[string]string
+		err    string
+	}{
+		{
+			name:   "same schema",
+			actual: map[string]string{"a": "versions() > 1", "b": "age() > 7d"},
+		},
+		{
+			name:   "missing family",
+			actual: map[string]string{"a": "versions() > 1"},
+			err:    "Table index_1 already exists with a different schema: column family b is missing",
+		},
+		{
+			name:   "extra family",
+			actual: map[string]string{"a": "versions() > 1", "b": "age() > 7d", "c": ""},
+			err:    "Table index_1 already exists with a different schema: column family c is not in the backup",
+		},
+		{
+			name:   "different GC rules",
+			actual: map[string]string{"a": "versions() > 2", "b": "age() > 7d", "d": ""},
+			err: `Table index_1 already exists with a different schema: column family a has GC rule "versions() > 2" instead of "versions() > 1", ` +
+				"column family d is not in the backup",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkGCPolicies("index_1", expected, tc.actual)
+			if tc.err == "" && err != nil {
+				t.Errorf("Unexpected error %v", err)
+			}
+			if tc.err != "" && (err == nil || err.Error() != tc.err) {
+				t.Errorf("Expected error %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestCreateTable(t *testing.T) {
+	_, admin, cleanup := newTestBigtable(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	schema := &bigtableAdminV2.Table{ColumnFamilies: map[string]bigtableAdminV2.ColumnFamily{
+		"a": {GcRule: &bigtableAdminV2.GcRule{MaxNumVersions: 1}},
+		"b": {GcRule: &bigtableAdminV2.GcRule{Union: &bigtableAdminV2.Union{Rules: []*bigtableAdminV2.GcRule{
+			{MaxAge: "604800s"},
+			{MaxNumVersions: 10},
+		}}}},
+	}}
+	if err := createTable(ctx, "project", "instance", "restored", schema); err != nil {
+		t.Fatal(err)
+	}
+	info, err := admin.TableInfo(ctx, "restored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies := map[string]string{}
+	for _, family := range info.FamilyInfos {
+		policies[family.Name] = family.GCPolicy
+	}
+	if expected := map[string]string{"a": "versions() > 1", "b": "(age() > 7d || versions() > 10)"}; !reflect.DeepEqual(policies, expected) {
+		t.Errorf("Created column families %v instead of %v", policies, expected)
+	}
+
+	// Restoring to the existing table again checks its schema.
+	if err := createTable(ctx, "project", "instance", "restored", schema); err != nil {
+		t.Errorf("Unexpected error for the same schema: %v", err)
+	}
+	schema.ColumnFamilies["a"] = bigtableAdminV2.ColumnFamily{GcRule: &bigtableAdminV2.GcRule{MaxNumVersions: 2}}
+	err = createTable(ctx, "project", "instance", "restored", schema)
+	if expected := `Table restored already exists with a different schema: column family a has GC rule "versions() > 1" instead of "versions() > 2"`; err == nil || err.Error() != expected {
+		t.Errorf("Expected error %q, got %v", expected, err)
+	}
+}
+
+func TestAdminAPIListTables(t *testing.T) {
+	pages := map[string]string{
+		"":  `{"tables": [{"name": "projects/project/instances/instance/tables/index_1"}, {"name": "projects/project/instances/instance/tables/index_2"}], "nextPageToken": "2"}`,
+		"2": `{"tables": [{"name": "projects/project/instances/instance/tables/index_3"}], "nextPageToken": "3"}`,
+		"3": `{}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, ok := pages[r.URL.Query().Get("pageToken")]
+		if r.URL.Path != "/v2/projects/project/instances/instance/tables" || !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(page))
+	}))
+	defer server.Close()
+
+	admin := &adminAPI{
+		projectID:  "project",
+		instanceID: "instance",
+		opts:       []option.ClientOption{option.WithEndpoint(server.URL + "/"), option.WithHTTPClient(server.Client())},
+	}
+	tableIDs, err := admin.ListTables(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"index_1", "index_2", "index_3"}; !reflect.DeepEqual(tableIDs, expected) {
+		t.Errorf("Listed tables %v instead of %v", tableIDs, expected)
+	}
+}
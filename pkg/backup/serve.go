@@ -0,0 +1,309 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/robfig/cron"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// ServeConfig is the config for Serve command.
+type ServeConfig struct {
+	ConfigFile    string
+	ListenAddress string
+	BackupPath    string
+
+	// The HTTP API only reads and writes the backups in BackupPath and AllowedBackupPaths.
+	AllowedBackupPaths []string
+	// The restore and delete endpoints of the HTTP API are disabled unless enabled.
+	EnableRestoreAPI bool
+	EnableDeleteAPI  bool
+	// APITokenFile is the file with the bearer token required by the HTTP API. The API requires no token if not set.
+	APITokenFile string
+}
+
+// RegisterServeFlags registers the flags for Serve command.
+func RegisterServeFlags(cmd *kingpin.CmdClause) *ServeConfig {
+	config := ServeConfig{}
+	cmd.Flag("config-file", "Path of the JSON file with the scheduled backups. If not set, only the HTTP API is served").StringVar(&config.ConfigFile)
+	cmd.Flag("listen-address", "Address of the HTTP server").Default(":80").StringVar(&config.ListenAddress)
+	cmd.Flag("backup-path", "Default path of the backups of the HTTP API. Supports gs:// and file:// paths").StringVar(&config.BackupPath)
+	cmd.Flag("api-allowed-backup-path", "Other path of backups which the HTTP API can read and write. Can be repeated").StringsVar(&config.AllowedBackupPaths)
+	cmd.Flag("api-enable-restore", "Enable POST /restores of the HTTP API, which restores backups to any table").BoolVar(&config.EnableRestoreAPI)
+	cmd.Flag("api-enable-delete", "Enable DELETE /backups of the HTTP API, which deletes backups").BoolVar(&config.EnableDeleteAPI)
+	cmd.Flag("api-token-file", "File with the bearer token required by the requests to the HTTP API").StringVar(&config.APITokenFile)
+	return &config
+}
+
+// ScheduleConfig is the content of the config file of Serve command.
+type ScheduleConfig struct {
+	Backups []*ScheduledBackup `json:"backups"`
+}
+
+// ScheduledBackup backs up the tables with a prefix on a cron schedule, and then prunes their backups.
+type ScheduledBackup struct {
+	// Schedule is a cron expression with 5 fields, or a descriptor like @daily.
+	Schedule              string `json:"schedule"`
+	BigtableProjectID     string `json:"bigtable_project_id"`
+	BigtableInstanceID    string `json:"bigtable_instance_id"`
+	BigtableTableIDPrefix string `json:"bigtable_table_id_prefix"`
+	DestinationPath       string `json:"destination_path"`
+	TempPrefix            string `json:"temp_prefix"`
+	JobLocation           string `json:"job_location"`
+	Runner                string `json:"runner"`
+	Parallelism           int    `json:"parallelism"`
+	// ContinueOnError defaults to true.
+	ContinueOnError *bool `json:"continue_on_error,omitempty"`
+	// Retention prunes the backups of the tables after they are backed up. Backups are never pruned if it is not set.
+	Retention *RetentionConfig `json:"retention,omitempty"`
+
+	schedule cron.Schedule
+	mtx      sync.Mutex
+	running  bool
+
+	// The JobRunner, TableAdmin and JobStateCheckInterval of the backups, only set by tests.
+	jobRunner             JobRunner
+	tableAdmin            TableAdmin
+	jobStateCheckInterval time.Duration
+}
+
+// RetentionConfig has the retention policies of the backups, like the flags of PruneBackups command.
+type RetentionConfig struct {
+	KeepLast int `json:"keep_last"`
+	// KeepWithin is a duration like 720h.
+	KeepWithin  string `json:"keep_within"`
+	KeepDaily   int    `json:"keep_daily"`
+	KeepWeekly  int    `json:"keep_weekly"`
+	KeepMonthly int    `json:"keep_monthly"`
+
+	keepWithin time.Duration
+}
+
+func loadScheduleConfig(path string) (*ScheduleConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var config ScheduleConfig
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("Error parsing config file %s with error: %s", path, err)
+	}
+
+	if len(config.Backups) == 0 {
+		return nil, errors.New("No scheduled backups in the config file")
+	}
+	for _, scheduledBackup := range config.Backups {
+		if err := scheduledBackup.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &config, nil
+}
+
+func (b *ScheduledBackup) validate() error {
+	if b.BigtableProjectID == "" || b.BigtableInstanceID == "" || b.DestinationPath == "" {
+		return fmt.Errorf("Scheduled backup of prefix %q requires bigtable_project_id, bigtable_instance_id and destination_path", b.BigtableTableIDPrefix)
+	}
+
+	var err error
+	if b.schedule, err = cron.ParseStandard(b.Schedule); err != nil {
+		return fmt.Errorf("Invalid schedule %q of backup of prefix %q with error: %s", b.Schedule, b.BigtableTableIDPrefix, err)
+	}
+
+	if b.JobLocation == "" {
+		b.JobLocation = "us-central1"
+	}
+	switch b.Runner {
+	case "":
+		b.Runner = dataflowRunner
+	case dataflowRunner, localRunner:
+	default:
+		return fmt.Errorf("Unknown runner %q of backup of prefix %q, either %s or %s", b.Runner, b.BigtableTableIDPrefix, dataflowRunner, localRunner)
+	}
+	if b.Runner == dataflowRunner && b.TempPrefix == "" {
+		return fmt.Errorf("Scheduled backup of prefix %q requires temp_prefix with the %s runner", b.BigtableTableIDPrefix, dataflowRunner)
+	}
+
+	if b.Retention != nil {
+		r := b.Retention
+		if r.KeepLast == 0 && r.KeepWithin == "" && r.KeepDaily == 0 && r.KeepWeekly == 0 && r.KeepMonthly == 0 {
+			return fmt.Errorf("Retention of backup of prefix %q has no policy, at least one of the keep_ fields is required", b.BigtableTableIDPrefix)
+		}
+		if r.KeepWithin != "" {
+			if r.keepWithin, err = time.ParseDuration(r.KeepWithin); err != nil {
+				return fmt.Errorf("Invalid keep_within %q of backup of prefix %q with error: %s", r.KeepWithin, b.BigtableTableIDPrefix, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Run backs up the tables and prunes their backups, unless the previous run is still running.
+func (b *ScheduledBackup) Run() {
+	b.mtx.Lock()
+	if b.running {
+		b.mtx.Unlock()
+		log.Printf("Skipping backup of prefix %q, the previous run is still running", b.BigtableTableIDPrefix)
+		return
+	}
+	b.running = true
+	b.mtx.Unlock()
+
+	defer func() {
+		b.mtx.Lock()
+		b.running = false
+		b.mtx.Unlock()
+	}()
+
+	log.Printf("Starting backup of prefix %q", b.BigtableTableIDPrefix)
+	err := CreateBackup(&CreateBackupConfig{
+		BigtableProjectID:     b.BigtableProjectID,
+		BigtableInstanceID:    b.BigtableInstanceID,
+		BigtableTableIDPrefix: b.BigtableTableIDPrefix,
+		DestinationPath:       b.DestinationPath,
+		TempPrefix:            b.TempPrefix,
+		JobLocation:           b.JobLocation,
+		Runner:                b.Runner,
+		Parallelism:           b.Parallelism,
+		ContinueOnError:       b.ContinueOnError == nil || *b.ContinueOnError,
+		JobRunner:             b.jobRunner,
+		JobStateCheckInterval: b.jobStateCheckInterval,
+		TableAdmin:            b.tableAdmin,
+	})
+	if err != nil {
+		log.Printf("Error backing up prefix %q: %v", b.BigtableTableIDPrefix, err)
+	} else {
+		log.Printf("Finished backup of prefix %q", b.BigtableTableIDPrefix)
+	}
+
+	// Pruning only deletes the backups not kept by the policies, so it is safe even if the backup failed.
+	if b.Retention == nil {
+		return
+	}
+	err = PruneBackups(&PruneBackupsConfig{
+		BackupPath:            b.DestinationPath,
+		BigtableTableIDPrefix: b.BigtableTableIDPrefix,
+		KeepLast:              b.Retention.KeepLast,
+		KeepWithin:            b.Retention.keepWithin,
+		KeepDaily:             b.Retention.KeepDaily,
+		KeepWeekly:            b.Retention.KeepWeekly,
+		KeepMonthly:           b.Retention.KeepMonthly,
+	})
+	if err != nil {
+		log.Printf("Error pruning backups of prefix %q: %v", b.BigtableTableIDPrefix, err)
+	}
+}
+
+// Serve runs the scheduled backups and the HTTP API until it is interrupted.
+func Serve(config *ServeConfig) error {
+	api, err := newAPI(config)
+	if err != nil {
+		return err
+	}
+
+	c := cron.New()
+	// The backup path of the HTTP API has the backups of any table.
+	destinations := map[string][]string{}
+	if config.BackupPath != "" {
+		destinations[config.BackupPath] = []string{""}
+	}
+	if config.ConfigFile != "" {
+		scheduleConfig, err := loadScheduleConfig(config.ConfigFile)
+		if err != nil {
+			return err
+		}
+
+		for _, scheduledBackup := range scheduleConfig.Backups {
+			c.Schedule(scheduledBackup.schedule, scheduledBackup)
+			log.Printf("Scheduled backup of prefix %q with schedule %q", scheduledBackup.BigtableTableIDPrefix, scheduledBackup.Schedule)
+			destinations[scheduledBackup.DestinationPath] = append(destinations[scheduledBackup.DestinationPath], scheduledBackup.BigtableTableIDPrefix)
+		}
+	}
+
+	// The metrics of the backups made before a restart are set from their manifests, before any new backup can set them.
+	for path, prefixes := range destinations {
+		if err := setLastSuccessfulBackupTimestamps(context.Background(), path, prefixes); err != nil {
+			log.Printf("Error reading the last successful backups in %s: %v", path, err)
+		}
+	}
+	c.Start()
+	defer c.Stop()
+
+	mux := http.NewServeMux()
+	api.register(mux)
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "OK")
+	})
+	server := &http.Server{Addr: config.ListenAddress, Handler: mux}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		log.Printf("Received %s, shutting down", sig)
+	}
+
+	// The running backups are abandoned, they are incomplete until their manifest is written.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return server.Shutdown(ctx)
+}
+
+// setLastSuccessfulBackupTimestamps sets the timestamp of the newest complete backup of every table with one of the prefixes in the path.
+func setLastSuccessfulBackupTimestamps(ctx context.Context, path string, prefixes []string) error {
+	store, err := NewBackupStore(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	tableIDs, err := store.ListPrefixes(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	for _, tableID := range tableIDs {
+		matches := false
+		for _, prefix := range prefixes {
+			matches = matches || strings.HasPrefix(tableID, prefix)
+		}
+		if !matches {
+			continue
+		}
+
+		backup, err := newestCompleteBackup(ctx, store, tableID, time.Time{})
+		if err != nil {
+			return err
+		}
+		if backup != nil {
+			lastSuccessfulBackupTimestamp.WithLabelValues(tableID).Set(float64(backup.Timestamp))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestSetLastSuccessfulBackupTimestamps(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	writeTestBackup(t, store, "serve_index_1", 100, 0, true)
+	writeTestBackup(t, store, "serve_index_1", 200, 0, true)
+	writeTestBackup(t, store, "serve_index_1", 300, 0, false)
+	writeTestBackup(t, store, "serve_index_2", 100, 0, false)
+	writeTestBackup(t, store, "serve_chunks_1", 100, 0, true)
+
+	if err := setLastSuccessfulBackupTimestamps(context.Background(), path, []string{"serve_index_"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for tableID, expected := range map[string]float64{"serve_index_1": 200, "serve_index_2": 0, "serve_chunks_1": 0} {
+		var metric dto.Metric
+		if err := lastSuccessfulBackupTimestamp.WithLabelValues(tableID).Write(&metric); err != nil {
+			t.Fatal(err)
+		}
+		if value := metric.GetGauge().GetValue(); value != expected {
+			t.Errorf("Last successful backup of %s is %v instead of %v", tableID, value, expected)
+		}
+	}
+}
+
+func writeTestScheduleConfig(t *testing.T, config string) string {
+	f, err := ioutil.TempFile("", "bigtable-backup-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(config); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestLoadScheduleConfig(t *testing.T) {
+	const valid = `"schedule": "0 2 * * *", "bigtable_project_id": "project", "bigtable_instance_id": "instance", "destination_path": "gs://bucket/backups"`
+	for _, tc := range []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{
+			name:   "dataflow runner",
+			config: `{"backups": [{` + valid + `, "temp_prefix": "gs://bucket/tmp", "retention": {"keep_last": 3, "keep_within": "720h"}}]}`,
+		},
+		{
+			name:   "local runner",
+			config: `{"backups": [{` + valid + `, "runner": "local"}]}`,
+		},
+		{
+			name:   "no scheduled backups",
+			config: `{"backups": []}`,
+			err:    "No scheduled backups in the config file",
+		},
+		{
+			name:   "unknown field",
+			config: `{"backups": [{` + valid + `, "runner": "local", "keep_last": 3}]}`,
+			err:    `json: unknown field "keep_last"`,
+		},
+		{
+			name:   "missing destination path",
+			config: `{"backups": [{"schedule": "@daily", "bigtable_project_id": "project", "bigtable_instance_id": "instance", "runner": "local"}]}`,
+			err:    "requires bigtable_project_id, bigtable_instance_id and destination_path",
+		},
+		{
+			name:   "invalid schedule",
+			config: `{"backups": [{` + strings.Replace(valid, "0 2 * * *", "0 2 * *", 1) + `, "runner": "local"}]}`,
+			err:    `Invalid schedule "0 2 * *"`,
+		},
+		{
+			name:   "unknown runner",
+			config: `{"backups": [{` + valid + `, "runner": "dataproc"}]}`,
+			err:    `Unknown runner "dataproc" of backup of prefix ""`,
+		},
+		{
+			name:   "dataflow runner without temp prefix",
+			config: `{"backups": [{` + valid + `}]}`,
+			err:    `requires temp_prefix with the dataflow runner`,
+		},
+		{
+			name:   "retention without policy",
+			config: `{"backups": [{` + valid + `, "runner": "local", "retention": {}}]}`,
+			err:    "has no policy, at least one of the keep_ fields is required",
+		},
+		{
+			name:   "invalid keep within",
+			config: `{"backups": [{` + valid + `, "runner": "local", "retention": {"keep_within": "30d"}}]}`,
+			err:    `Invalid keep_within "30d"`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeTestScheduleConfig(t, tc.config)
+			defer os.Remove(path)
+
+			config, err := loadScheduleConfig(path)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("Expected error with %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			scheduledBackup := config.Backups[0]
+			if scheduledBackup.schedule == nil || scheduledBackup.JobLocation != "us-central1" || scheduledBackup.Runner == "" {
+				t.Errorf("Defaults not set on %+v", scheduledBackup)
+			}
+			if scheduledBackup.Retention != nil && scheduledBackup.Retention.keepWithin != 720*time.Hour {
+				t.Errorf("Parsed keep_within to %v", scheduledBackup.Retention.keepWithin)
+			}
+		})
+	}
+}
+
+// blockingTableAdmin blocks the listing of the tables until unblock is closed.
+type blockingTableAdmin struct {
+	fakeTableAdmin
+	listed  chan struct{}
+	unblock chan struct{}
+}
+
+func (a blockingTableAdmin) ListTables(ctx context.Context) ([]string, error) {
+	a.listed <- struct{}{}
+	<-a.unblock
+	return a.fakeTableAdmin.ListTables(ctx)
+}
+
+func TestScheduledBackupRunOverlap(t *testing.T) {
+	_, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	admin := blockingTableAdmin{fakeTableAdmin: testTableAdmin(), listed: make(chan struct{}, 2), unblock: make(chan struct{})}
+	runner := NewFakeJobRunner()
+	scheduledBackup := &ScheduledBackup{
+		Schedule:              "@daily",
+		BigtableProjectID:     "project",
+		BigtableInstanceID:    "instance",
+		BigtableTableIDPrefix: "index_",
+		DestinationPath:       path,
+		Runner:                localRunner,
+		jobRunner:             runner,
+		tableAdmin:            admin,
+		jobStateCheckInterval: time.Millisecond,
+	}
+	if err := scheduledBackup.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	captureStdout(t, func() {
+		done := make(chan struct{})
+		go func() {
+			scheduledBackup.Run()
+			close(done)
+		}()
+		<-admin.listed
+
+		// The next run is skipped while the first one is running.
+		scheduledBackup.Run()
+		if !strings.Contains(logs.String(), `Skipping backup of prefix "index_", the previous run is still running`) {
+			t.Errorf("Expected the second run to be skipped, got logs:\n%s", logs.String())
+		}
+
+		close(admin.unblock)
+		<-done
+		if jobs := runner.ExportJobs(); len(jobs) != 3 {
+			t.Errorf("Expected one export job per table, got %+v", jobs)
+		}
+
+		// Once the first run is finished, the next one runs.
+		scheduledBackup.Run()
+		if jobs := runner.ExportJobs(); len(jobs) != 6 {
+			t.Errorf("Expected the tables to be backed up again, got %d export jobs", len(jobs))
+		}
+	})
+}
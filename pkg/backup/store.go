@@ -0,0 +1,69 @@
+package backup
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	gcsScheme   = "gs://"
+	localScheme = "file://"
+)
+
+// ObjectAttrs has the attributes of an object in a BackupStore.
+type ObjectAttrs struct {
+	// Name of the object relative to the root of the store.
+	Name string
+	Size int64
+	// CRC32C and MD5 are the base64 encoded checksums of the object, like GCS
+	// reports them. They are empty when the store does not keep checksums.
+	CRC32C string
+	MD5    string
+}
+
+// BackupStore is the storage where backups are kept.
+// All the object names are relative to the root of the store.
+type BackupStore interface {
+	// ListObjects lists all the objects with names starting with prefix.
+	ListObjects(ctx context.Context, prefix string) ([]ObjectAttrs, error)
+	// ListPrefixes lists the names of the "directories" directly under prefix, without the trailing "/".
+	ListPrefixes(ctx context.Context, prefix string) ([]string, error)
+	NewReader(ctx context.Context, name string) (io.ReadCloser, error)
+	// NewWriter returns a writer for the object. The object is created when the writer is closed.
+	NewWriter(ctx context.Context, name string) (ObjectWriter, error)
+	DeleteObject(ctx context.Context, name string) error
+	// URL returns the full URL of the object, including the scheme of the store.
+	URL(name string) string
+}
+
+// ObjectWriter writes an object of a BackupStore.
+type ObjectWriter interface {
+	io.Writer
+	// Close creates the object with the data written.
+	Close() error
+	// Abort discards the data written, without creating the object.
+	Abort()
+}
+
+// NewBackupStore returns the BackupStore for the path based on its URL scheme.
+// Paths without a scheme are treated as GCS paths.
+func NewBackupStore(ctx context.Context, path string) (BackupStore, error) {
+	if strings.HasPrefix(path, localScheme) {
+		return newLocalStore(path[len(localScheme):])
+	}
+
+	return newGCSStore(ctx, path)
+}
+
+// isNotExist returns whether the error is about an object missing from a BackupStore.
+func isNotExist(err error) bool {
+	if apiErr, ok := err.(*googleapi.Error); ok {
+		return apiErr.Code == http.StatusNotFound
+	}
+	return os.IsNotExist(err)
+}
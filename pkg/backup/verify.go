@@ -0,0 +1,134 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/grafana/bigtable-backup/pkg/seqfile"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// VerifyBackupConfig has the config for VerifyBackup command.
+type VerifyBackupConfig struct {
+	BackupPath      string
+	BigtableTableID string
+	BackupTimestamp int64
+}
+
+// RegisterVerifyBackupFlags registers the flags for VerifyBackup command.
+func RegisterVerifyBackupFlags(cmd *kingpin.CmdClause) *VerifyBackupConfig {
+	config := VerifyBackupConfig{}
+	cmd.Flag("backup-path", "Path where backups can be found. Supports gs:// and file:// paths").Required().StringVar(&config.BackupPath)
+	cmd.Flag("bigtable-table-id", "ID of the bigtable table of the backup").Required().StringVar(&config.BigtableTableID)
+	cmd.Flag("backup-timestamp", "Timestamp of the backup to verify. If not set, most recent backup would be verified").Int64Var(&config.BackupTimestamp)
+	return &config
+}
+
+// VerifyBackup reads every record of every shard of a backup and reports the
+// shards which are corrupt or truncated. It returns an error if any shard is.
+func VerifyBackup(config *VerifyBackupConfig) error {
+	ctx := context.Background()
+	store, err := NewBackupStore(ctx, config.BackupPath)
+	if err != nil {
+		return err
+	}
+
+	timestamps, err := listBackupTimestamps(ctx, store, config.BigtableTableID)
+	if err != nil {
+		return err
+	}
+	if len(timestamps) == 0 {
+		return fmt.Errorf("No backups found for table %s", config.BigtableTableID)
+	}
+	if config.BackupTimestamp == 0 {
+		config.BackupTimestamp = timestamps[len(timestamps)-1]
+	}
+	if !containsTimestamp(timestamps, config.BackupTimestamp) {
+		return fmt.Errorf("No backup found for table %s with timestamp %d", config.BigtableTableID, config.BackupTimestamp)
+	}
+	manifest, err := readManifest(ctx, store, config.BigtableTableID, config.BackupTimestamp)
+	if err != nil {
+		return err
+	}
+	tableBackup := &Backup{Timestamp: config.BackupTimestamp, Manifest: manifest}
+
+	prefix := fmt.Sprintf("%s/%d/%s%s", config.BigtableTableID, config.BackupTimestamp, config.BigtableTableID, bigtableIDSeparatorInSeqFileName)
+	objects, err := store.ListObjects(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	if len(objects) == 0 {
+		return fmt.Errorf("No SequenceFiles found for table %s with timestamp %d", config.BigtableTableID, config.BackupTimestamp)
+	}
+
+	// The shards of complete backups are checked against their manifest.
+	manifestShards := map[string]ManifestShard{}
+	if tableBackup.Complete() {
+		for _, shard := range tableBackup.Manifest.Shards {
+			manifestShards[shard.Name] = shard
+		}
+	} else {
+		fmt.Println("Backup has no manifest, it may be incomplete")
+	}
+
+	var rows, cells, size int64
+	corruptShards := 0
+	for _, object := range objects {
+		if tableBackup.Complete() {
+			shard, ok := manifestShards[object.Name]
+			delete(manifestShards, object.Name)
+			if !ok {
+				corruptShards++
+				fmt.Printf("CORRUPT %s: not in the manifest\n", object.Name)
+				continue
+			}
+			if shard.Size != object.Size || (object.CRC32C != "" && shard.CRC32C != object.CRC32C) {
+				corruptShards++
+				fmt.Printf("CORRUPT %s: size or checksum does not match the manifest\n", object.Name)
+				continue
+			}
+		}
+
+		var shardRows, shardCells int64
+		err := forEachRow(ctx, store, object.Name, func(rowKey []byte, rowCells []seqfile.Cell) error {
+			shardRows++
+			shardCells += int64(len(rowCells))
+			return nil
+		})
+		if err != nil {
+			corruptShards++
+			fmt.Printf("CORRUPT %s: %s (after %d rows)\n", object.Name, err, shardRows)
+			continue
+		}
+
+		fmt.Printf("OK %s: %d rows, %d cells, %d bytes\n", object.Name, shardRows, shardCells, object.Size)
+		rows += shardRows
+		cells += shardCells
+		size += object.Size
+	}
+
+	for name := range manifestShards {
+		fmt.Printf("MISSING %s\n", name)
+	}
+
+	fmt.Printf("Verified backup for table %s with timestamp %d: %d shards, %d rows, %d cells, %d bytes\n",
+		config.BigtableTableID, config.BackupTimestamp, len(objects)-corruptShards, rows, cells, size)
+
+	if corruptShards > 0 {
+		return fmt.Errorf("%d of %d shards of the backup are corrupt", corruptShards, len(objects))
+	}
+	if len(manifestShards) > 0 {
+		return fmt.Errorf("%d shards of the backup are missing", len(manifestShards))
+	}
+
+	return nil
+}
+
+func containsTimestamp(timestamps []int64, timestamp int64) bool {
+	for _, t := range timestamps {
+		if t == timestamp {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,201 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/grafana/bigtable-backup/pkg/seqfile"
+)
+
+// writeTestShards writes a backup of 60 rows in 3 shards, each with sync markers after its header,
+// and its manifest unless the backup is incomplete. It returns the names of the shards.
+func writeTestShards(t *testing.T, store BackupStore, complete bool) []string {
+	ctx := context.Background()
+	w := &shardWriter{ctx: ctx, store: store, filenamePrefix: "index_1/100/index_1:", shardSize: 4096}
+	for i := 0; i < 60; i++ {
+		row := fmt.Sprintf("row%03d", i)
+		err := w.append(bigtable.Row{"f": {{Row: row, Column: "f:c", Timestamp: ms(1000), Value: bytes.Repeat([]byte("v"), 100)}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	shards, err := listShards(ctx, store, "index_1", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shards) != 3 {
+		t.Fatalf("Wrote %d shards instead of 3", len(shards))
+	}
+	if complete {
+		if err := writeManifest(ctx, store, &Manifest{BigtableTableID: "index_1", Timestamp: 100, Shards: shards}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names := make([]string, 0, len(shards))
+	for _, shard := range shards {
+		names = append(names, shard.Name)
+	}
+	return names
+}
+
+func readTestObject(t *testing.T, store BackupStore, name string) []byte {
+	r, err := store.NewReader(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func replaceTestObject(t *testing.T, store BackupStore, name string, data []byte) {
+	w, err := store.NewWriter(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// corruptSyncMarker flips a byte of the last sync marker of a SequenceFile, which is not the one of its header.
+func corruptSyncMarker(t *testing.T, data []byte) []byte {
+	r, err := seqfile.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sync := r.Header().Sync
+	first, last := bytes.Index(data, sync[:]), bytes.LastIndex(data, sync[:])
+	if first == last {
+		t.Fatal("Expected a sync marker after the header")
+	}
+	corrupt := append([]byte(nil), data...)
+	corrupt[last] ^= 0xff
+	return corrupt
+}
+
+func TestVerifyBackup(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		complete bool
+		corrupt  func(t *testing.T, store BackupStore, shards []string)
+		err      string
+		output   []string
+	}{
+		{
+			name:     "complete backup",
+			complete: true,
+			output: []string{
+				"OK index_1/100/index_1:-00000", "OK index_1/100/index_1:-00001", "OK index_1/100/index_1:-00002",
+				"Verified backup for table index_1 with timestamp 100: 3 shards, 60 rows, 60 cells",
+			},
+		},
+		{
+			name:   "backup without manifest",
+			output: []string{"Backup has no manifest, it may be incomplete", "3 shards, 60 rows, 60 cells"},
+		},
+		{
+			name: "truncated shard",
+			corrupt: func(t *testing.T, store BackupStore, shards []string) {
+				data := readTestObject(t, store, shards[1])
+				replaceTestObject(t, store, shards[1], data[:len(data)-10])
+			},
+			err:    "1 of 3 shards of the backup are corrupt",
+			output: []string{"CORRUPT index_1/100/index_1:-00001: unexpected EOF", "2 shards"},
+		},
+		{
+			name: "sync marker mismatch",
+			corrupt: func(t *testing.T, store BackupStore, shards []string) {
+				replaceTestObject(t, store, shards[0], corruptSyncMarker(t, readTestObject(t, store, shards[0])))
+			},
+			err:    "1 of 3 shards of the backup are corrupt",
+			output: []string{"CORRUPT index_1/100/index_1:-00000: " + seqfile.ErrSyncMismatch.Error(), "OK index_1/100/index_1:-00001"},
+		},
+		{
+			name:     "shard missing from the backup",
+			complete: true,
+			corrupt: func(t *testing.T, store BackupStore, shards []string) {
+				if err := store.DeleteObject(context.Background(), shards[2]); err != nil {
+					t.Fatal(err)
+				}
+			},
+			err:    "1 shards of the backup are missing",
+			output: []string{"MISSING index_1/100/index_1:-00002", "2 shards"},
+		},
+		{
+			name:     "shard missing from the manifest",
+			complete: true,
+			corrupt: func(t *testing.T, store BackupStore, shards []string) {
+				replaceTestObject(t, store, "index_1/100/index_1:-00003", readTestObject(t, store, shards[0]))
+			},
+			err:    "1 of 4 shards of the backup are corrupt",
+			output: []string{"CORRUPT index_1/100/index_1:-00003: not in the manifest", "3 shards"},
+		},
+		{
+			name:     "size mismatch",
+			complete: true,
+			corrupt: func(t *testing.T, store BackupStore, shards []string) {
+				replaceTestObject(t, store, shards[1], append(readTestObject(t, store, shards[1]), 0))
+			},
+			err:    "1 of 3 shards of the backup are corrupt",
+			output: []string{"CORRUPT index_1/100/index_1:-00001: size or checksum does not match the manifest"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store, path, cleanup := newTestStore(t)
+			defer cleanup()
+
+			shards := writeTestShards(t, store, tc.complete)
+			if tc.corrupt != nil {
+				tc.corrupt(t, store, shards)
+			}
+
+			var err error
+			output := captureStdout(t, func() {
+				err = VerifyBackup(&VerifyBackupConfig{BackupPath: path, BigtableTableID: "index_1"})
+			})
+			if tc.err == "" && err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			if tc.err != "" && (err == nil || err.Error() != tc.err) {
+				t.Fatalf("Expected error %q, got %v", tc.err, err)
+			}
+			for _, expected := range tc.output {
+				if !strings.Contains(string(output), expected) {
+					t.Errorf("Expected %q in the output:\n%s", expected, output)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyBackupNotFound(t *testing.T) {
+	store, path, cleanup := newTestStore(t)
+	defer cleanup()
+
+	if err := VerifyBackup(&VerifyBackupConfig{BackupPath: path, BigtableTableID: "index_1"}); err == nil {
+		t.Error("Expected an error verifying a table without backups")
+	}
+
+	writeTestShards(t, store, true)
+	err := VerifyBackup(&VerifyBackupConfig{BackupPath: path, BigtableTableID: "index_1", BackupTimestamp: 200})
+	if err == nil || err.Error() != "No backup found for table index_1 with timestamp 200" {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
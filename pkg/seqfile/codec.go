@@ -0,0 +1,168 @@
+package seqfile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+)
+
+// Class names of the supported Hadoop compression codecs.
+const (
+	DefaultCodecClassName = "org.apache.hadoop.io.compress.DefaultCodec"
+	DeflateCodecClassName = "org.apache.hadoop.io.compress.DeflateCodec"
+	GzipCodecClassName    = "org.apache.hadoop.io.compress.GzipCodec"
+	SnappyCodecClassName  = "org.apache.hadoop.io.compress.SnappyCodec"
+)
+
+// Codec compresses and decompresses the values, or the blocks, of a SequenceFile.
+type Codec interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var codecs = map[string]Codec{
+	DefaultCodecClassName: zlibCodec{},
+	DeflateCodecClassName: zlibCodec{},
+	GzipCodecClassName:    gzipCodec{},
+	SnappyCodecClassName:  snappyCodec{},
+}
+
+// CodecByClassName returns the Codec for the Hadoop codec class name.
+func CodecByClassName(className string) (Codec, error) {
+	codec, ok := codecs[className]
+	if !ok {
+		return nil, fmt.Errorf("unsupported compression codec %s", className)
+	}
+	return codec, nil
+}
+
+// zlibCodec is Hadoop's DefaultCodec, which writes zlib streams.
+type zlibCodec struct{}
+
+func (zlibCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (zlibCodec) Decompress(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+const (
+	// snappyBufferSize is Hadoop's default io.compression.codec.snappy.buffersize.
+	snappyBufferSize = 256 * 1024
+	// snappyChunkSize is the maximum size of the uncompressed chunks, the MAX_INPUT_SIZE of Hadoop's BlockCompressorStream,
+	// which leaves room for the overhead of the compression so that the compressed chunks fit in the buffer of the decompressor.
+	snappyChunkSize = snappyBufferSize - (snappyBufferSize/6 + 32)
+)
+
+// snappyCodec is Hadoop's SnappyCodec. Hadoop frames the raw snappy data in blocks,
+// each of them being the uncompressed length of the block followed by its compressed
+// chunks. Every chunk is prefixed by its compressed length.
+type snappyCodec struct{}
+
+func (snappyCodec) Compress(data []byte) ([]byte, error) {
+	buf := make([]byte, 4, 4+snappy.MaxEncodedLen(len(data)))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+
+	for len(data) > 0 {
+		n := len(data)
+		if n > snappyChunkSize {
+			n = snappyChunkSize
+		}
+
+		compressed := snappy.Encode(nil, data[:n])
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(compressed)))
+		buf = append(append(buf, length[:]...), compressed...)
+		data = data[n:]
+	}
+
+	return buf, nil
+}
+
+func (snappyCodec) Decompress(data []byte) ([]byte, error) {
+	var out []byte
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		blockLength, err := readUint32(r)
+		if err != nil {
+			return nil, err
+		}
+
+		for remaining := int(blockLength); remaining > 0; {
+			chunkLength, err := readUint32(r)
+			if err != nil {
+				return nil, err
+			}
+			if int(chunkLength) > r.Len() {
+				return nil, io.ErrUnexpectedEOF
+			}
+
+			chunk := make([]byte, chunkLength)
+			r.Read(chunk)
+			decompressed, err := snappy.Decode(nil, chunk)
+			if err != nil {
+				return nil, err
+			}
+			if len(decompressed) > remaining {
+				return nil, errors.New("snappy chunk larger than its block")
+			}
+
+			out = append(out, decompressed...)
+			remaining -= len(decompressed)
+		}
+	}
+
+	return out, nil
+}
+
+func readUint32(r io.Reader) (uint32, error) {
+	var buf [4]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	return binary.BigEndian.Uint32(buf[:]), nil
+}
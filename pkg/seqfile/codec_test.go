@@ -0,0 +1,88 @@
+package seqfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/golang/snappy"
+)
+
+func TestCodecs(t *testing.T) {
+	data := testData(3 * snappyBufferSize)
+	for className, codec := range codecs {
+		for _, size := range []int{0, 1, snappyChunkSize, snappyChunkSize + 1, len(data)} {
+			compressed, err := codec.Compress(data[:size])
+			if err != nil {
+				t.Fatalf("%s: %v", className, err)
+			}
+			decompressed, err := codec.Decompress(compressed)
+			if err != nil {
+				t.Fatalf("%s: %v", className, err)
+			}
+			if !bytes.Equal(decompressed, data[:size]) {
+				t.Errorf("%s: data of size %d changed by its compression", className, size)
+			}
+		}
+	}
+}
+
+// TestSnappyChunks checks that the compressed chunks fit in the buffer of Hadoop's SnappyDecompressor,
+// which is the case of the chunks of at most MAX_INPUT_SIZE bytes written by Hadoop's BlockCompressorStream.
+func TestSnappyChunks(t *testing.T) {
+	// Random data is not compressible, so its compressed chunks are larger than the uncompressed ones.
+	data := make([]byte, 3*snappyBufferSize)
+	rand.New(rand.NewSource(0)).Read(data)
+
+	compressed, err := snappyCodec{}.Compress(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if length := binary.BigEndian.Uint32(compressed); int(length) != len(data) {
+		t.Fatalf("Block has length %d instead of %d", length, len(data))
+	}
+	compressed = compressed[4:]
+	chunks := 0
+	for len(compressed) > 0 {
+		length := int(binary.BigEndian.Uint32(compressed))
+		if length > snappyBufferSize {
+			t.Errorf("Compressed chunk of %d bytes does not fit in the buffer of %d bytes", length, snappyBufferSize)
+		}
+		decodedLength, err := snappy.DecodedLen(compressed[4 : 4+length])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decodedLength > snappyChunkSize {
+			t.Errorf("Chunk of %d bytes is larger than %d bytes", decodedLength, snappyChunkSize)
+		}
+		compressed = compressed[4+length:]
+		chunks++
+	}
+	if expected := (len(data) + snappyChunkSize - 1) / snappyChunkSize; chunks != expected {
+		t.Errorf("Data compressed in %d chunks instead of %d", chunks, expected)
+	}
+}
+
+func TestSnappyDecompressTruncated(t *testing.T) {
+	compressed, err := snappyCodec{}.Compress(testData(1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, length := range []int{2, 4, 6, 8, len(compressed) - 1} {
+		if _, err := (snappyCodec{}).Decompress(compressed[:length]); err == nil {
+			t.Errorf("Expected an error decompressing %d of %d bytes", length, len(compressed))
+		}
+	}
+}
+
+// testData returns compressible data of the given size.
+func testData(size int) []byte {
+	data := make([]byte, size)
+	r := rand.New(rand.NewSource(int64(size)))
+	for i := range data {
+		data[i] = "abcdefgh"[r.Intn(8)]
+	}
+	return data
+}
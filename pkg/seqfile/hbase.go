@@ -0,0 +1,201 @@
+package seqfile
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Class names of the keys and values in the SequenceFiles of the Bigtable backups.
+const (
+	ImmutableBytesWritableClassName = "org.apache.hadoop.hbase.io.ImmutableBytesWritable"
+	ResultClassName                 = "org.apache.hadoop.hbase.client.Result"
+)
+
+// Field numbers and wire types of the HBase ClientProtos.Result and CellProtos.Cell protobuf messages.
+const (
+	resultCellField    = 1<<3 | wireBytes
+	resultStaleField   = 4<<3 | wireVarint
+	resultPartialField = 5<<3 | wireVarint
+
+	cellRowField       = 1<<3 | wireBytes
+	cellFamilyField    = 2<<3 | wireBytes
+	cellQualifierField = 3<<3 | wireBytes
+	cellTimestampField = 4<<3 | wireVarint
+	cellTypeField      = 5<<3 | wireVarint
+	cellValueField     = 6<<3 | wireBytes
+
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+
+	// cellTypePut is the CellProtos.CellType of the cells written by puts.
+	cellTypePut = 4
+)
+
+var errInvalidProtobuf = errors.New("invalid protobuf message")
+
+// Cell is a cell of an HBase Result.
+type Cell struct {
+	Row       []byte
+	Family    []byte
+	Qualifier []byte
+	// Timestamp in milliseconds, as HBase uses them.
+	Timestamp int64
+	Value     []byte
+}
+
+// EncodeRowKey serializes the row key as an ImmutableBytesWritable.
+func EncodeRowKey(row []byte) []byte {
+	buf := make([]byte, 4+len(row))
+	binary.BigEndian.PutUint32(buf, uint32(len(row)))
+	copy(buf[4:], row)
+	return buf
+}
+
+// EncodeResult serializes the cells of a row the way HBase's ResultSerialization
+// does, which is a length delimited ClientProtos.Result protobuf message.
+func EncodeResult(cells []Cell) []byte {
+	var result []byte
+	for _, cell := range cells {
+		var c []byte
+		c = appendBytesField(c, cellRowField, cell.Row)
+		c = appendBytesField(c, cellFamilyField, cell.Family)
+		c = appendBytesField(c, cellQualifierField, cell.Qualifier)
+		c = appendVarintField(c, cellTimestampField, uint64(cell.Timestamp))
+		c = appendVarintField(c, cellTypeField, cellTypePut)
+		c = appendBytesField(c, cellValueField, cell.Value)
+
+		result = appendBytesField(result, resultCellField, c)
+	}
+	if len(cells) != 0 {
+		result = appendVarintField(result, resultStaleField, 0)
+		result = appendVarintField(result, resultPartialField, 0)
+	}
+
+	return appendUvarint(make([]byte, 0, len(result)+binary.MaxVarintLen32), uint64(len(result)), result...)
+}
+
+func appendBytesField(buf []byte, tag byte, value []byte) []byte {
+	buf = append(buf, tag)
+	return appendUvarint(buf, uint64(len(value)), value...)
+}
+
+func appendVarintField(buf []byte, tag byte, value uint64) []byte {
+	buf = append(buf, tag)
+	return appendUvarint(buf, value)
+}
+
+func appendUvarint(buf []byte, x uint64, suffix ...byte) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	buf = append(buf, tmp[:n]...)
+	return append(buf, suffix...)
+}
+
+// DecodeRowKey deserializes a row key serialized as an ImmutableBytesWritable.
+func DecodeRowKey(key []byte) ([]byte, error) {
+	if len(key) < 4 || int(binary.BigEndian.Uint32(key)) != len(key)-4 {
+		return nil, errors.New("invalid ImmutableBytesWritable")
+	}
+
+	return key[4:], nil
+}
+
+// DecodeResult deserializes the cells of a row serialized by HBase's ResultSerialization.
+func DecodeResult(value []byte) ([]Cell, error) {
+	length, n := binary.Uvarint(value)
+	if n <= 0 || uint64(len(value)-n) != length {
+		return nil, errors.New("invalid length of Result")
+	}
+
+	var cells []Cell
+	err := forEachField(value[n:], func(tag byte, varint uint64, bytes []byte) error {
+		if tag != resultCellField {
+			return nil
+		}
+
+		var cell Cell
+		err := forEachField(bytes, func(tag byte, varint uint64, bytes []byte) error {
+			switch tag {
+			case cellRowField:
+				cell.Row = bytes
+			case cellFamilyField:
+				cell.Family = bytes
+			case cellQualifierField:
+				cell.Qualifier = bytes
+			case cellTimestampField:
+				cell.Timestamp = int64(varint)
+			case cellValueField:
+				cell.Value = bytes
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		cells = append(cells, cell)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return cells, nil
+}
+
+// forEachField calls f with the tag and the value of every field of a protobuf message.
+// Varint fields set varint and length delimited fields set bytes. Fixed size fields are skipped.
+func forEachField(msg []byte, f func(tag byte, varint uint64, bytes []byte) error) error {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errInvalidProtobuf
+		}
+		msg = msg[n:]
+
+		var (
+			varint uint64
+			bytes  []byte
+		)
+		switch key & 7 {
+		case wireVarint:
+			varint, n = binary.Uvarint(msg)
+			if n <= 0 {
+				return errInvalidProtobuf
+			}
+			msg = msg[n:]
+		case wireBytes:
+			length, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < length {
+				return errInvalidProtobuf
+			}
+			bytes = msg[n : n+int(length)]
+			msg = msg[n+int(length):]
+		case wireFixed64, wireFixed32:
+			size := 8
+			if key&7 == wireFixed32 {
+				size = 4
+			}
+			if len(msg) < size {
+				return errInvalidProtobuf
+			}
+			msg = msg[size:]
+			continue
+		default:
+			return errInvalidProtobuf
+		}
+
+		// Tags of unknown fields may not fit in a byte, they are then ignored by f.
+		tag := byte(0)
+		if key < 1<<8 {
+			tag = byte(key)
+		}
+		if err := f(tag, varint, bytes); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
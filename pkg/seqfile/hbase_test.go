@@ -0,0 +1,206 @@
+package seqfile
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// hbaseCell and hbaseResult are the CellProtos.Cell and ClientProtos.Result messages of HBase's Cell.proto and Client.proto.
+// They are marshalled by the protobuf library to check the codec against another implementation of the messages.
+type hbaseCell struct {
+	Row       []byte  `protobuf:"bytes,1,opt,name=row"`
+	Family    []byte  `protobuf:"bytes,2,opt,name=family"`
+	Qualifier []byte  `protobuf:"bytes,3,opt,name=qualifier"`
+	Timestamp *uint64 `protobuf:"varint,4,opt,name=timestamp"`
+	CellType  *int32  `protobuf:"varint,5,opt,name=cell_type"`
+	Value     []byte  `protobuf:"bytes,6,opt,name=value"`
+	Tags      []byte  `protobuf:"bytes,7,opt,name=tags"`
+}
+
+func (m *hbaseCell) Reset()         { *m = hbaseCell{} }
+func (m *hbaseCell) String() string { return proto.CompactTextString(m) }
+func (*hbaseCell) ProtoMessage()    {}
+
+type hbaseResult struct {
+	Cell                []*hbaseCell `protobuf:"bytes,1,rep,name=cell"`
+	AssociatedCellCount *int32       `protobuf:"varint,2,opt,name=associated_cell_count"`
+	Exists              *bool        `protobuf:"varint,3,opt,name=exists"`
+	Stale               *bool        `protobuf:"varint,4,opt,name=stale"`
+	Partial             *bool        `protobuf:"varint,5,opt,name=partial"`
+}
+
+func (m *hbaseResult) Reset()         { *m = hbaseResult{} }
+func (m *hbaseResult) String() string { return proto.CompactTextString(m) }
+func (*hbaseResult) ProtoMessage()    {}
+
+// marshalDelimited marshals the message like the writeDelimitedTo of HBase's ResultSerialization.
+func marshalDelimited(t *testing.T, msg proto.Message) []byte {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(proto.EncodeVarint(uint64(len(data))), data...)
+}
+
+// testResultHex is a Result with two cells of row "row-1" as serialized by ResultSerialization, which sets stale and partial.
+const testResultHex = "3c" + // Length of the Result.
+	"0a20" + // First cell.
+	"0a05" + "726f772d31" + // row: "row-1"
+	"1201" + "66" + // family: "f"
+	"1a02" + "7131" + // qualifier: "q1"
+	"20" + "80b8a580ac2d" + // timestamp: 1558000000000
+	"2804" + // cell_type: PUT
+	"3207" + "76616c75652d31" + // value: "value-1"
+	"0a14" + // Second cell, written with timestamp 0 like Cortex does.
+	"0a05" + "726f772d31" + // row: "row-1"
+	"1201" + "66" + // family: "f"
+	"1a02" + "7132" + // qualifier: "q2"
+	"2000" + // timestamp: 0
+	"2804" + // cell_type: PUT
+	"3200" + // value: ""
+	"2000" + // stale: false
+	"2800" // partial: false
+
+var testResultCells = []Cell{
+	{Row: []byte("row-1"), Family: []byte("f"), Qualifier: []byte("q1"), Timestamp: 1558000000000, Value: []byte("value-1")},
+	{Row: []byte("row-1"), Family: []byte("f"), Qualifier: []byte("q2"), Timestamp: 0, Value: []byte{}},
+}
+
+func TestResultFixture(t *testing.T) {
+	fixture, err := hex.DecodeString(testResultHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if encoded := EncodeResult(testResultCells); !bytes.Equal(encoded, fixture) {
+		t.Errorf("Encoded %x instead of %x", encoded, fixture)
+	}
+	cells, err := DecodeResult(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cells, testResultCells) {
+		t.Errorf("Decoded %+v instead of %+v", cells, testResultCells)
+	}
+
+	// The fixture is what the protobuf library marshals for the same message.
+	put, timestamp, zero, stale := int32(cellTypePut), uint64(1558000000000), uint64(0), false
+	marshalled := marshalDelimited(t, &hbaseResult{
+		Cell: []*hbaseCell{
+			{Row: []byte("row-1"), Family: []byte("f"), Qualifier: []byte("q1"), Timestamp: &timestamp, CellType: &put, Value: []byte("value-1")},
+			{Row: []byte("row-1"), Family: []byte("f"), Qualifier: []byte("q2"), Timestamp: &zero, CellType: &put, Value: []byte{}},
+		},
+		Stale:   &stale,
+		Partial: &stale,
+	})
+	if !bytes.Equal(marshalled, fixture) {
+		t.Errorf("Protobuf library marshalled %x instead of %x", marshalled, fixture)
+	}
+}
+
+func TestDecodeResultOtherFields(t *testing.T) {
+	// Fields not written by EncodeResult, like the tags of the cells and the exists of the Result, are skipped.
+	put, timestamp, count, exists := int32(cellTypePut), uint64(42), int32(0), true
+	data := marshalDelimited(t, &hbaseResult{
+		Cell: []*hbaseCell{
+			{Row: []byte{0, 0xff}, Family: []byte("f"), Qualifier: []byte{0xfe}, Timestamp: &timestamp, CellType: &put, Value: []byte{1}, Tags: []byte("tags")},
+		},
+		AssociatedCellCount: &count,
+		Exists:              &exists,
+	})
+
+	cells, err := DecodeResult(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Cell{{Row: []byte{0, 0xff}, Family: []byte("f"), Qualifier: []byte{0xfe}, Timestamp: 42, Value: []byte{1}}}
+	if !reflect.DeepEqual(cells, expected) {
+		t.Errorf("Decoded %+v instead of %+v", cells, expected)
+	}
+}
+
+func TestEncodeResultUnmarshal(t *testing.T) {
+	cells := []Cell{
+		{Row: []byte("row"), Family: []byte("a"), Qualifier: []byte("x"), Timestamp: 1, Value: bytes.Repeat([]byte("v"), 300)},
+		{Row: []byte("row"), Family: []byte("b"), Qualifier: []byte{}, Timestamp: 1 << 50, Value: []byte{0}},
+	}
+	data := EncodeResult(cells)
+
+	length, n := proto.DecodeVarint(data)
+	if n == 0 || int(length) != len(data)-n {
+		t.Fatalf("Invalid length %d of Result of %d bytes", length, len(data))
+	}
+	var result hbaseResult
+	if err := proto.Unmarshal(data[n:], &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Cell) != len(cells) || result.Stale == nil || *result.Stale || result.Partial == nil || *result.Partial {
+		t.Fatalf("Unexpected Result %v", &result)
+	}
+	for i, cell := range result.Cell {
+		if !bytes.Equal(cell.Row, cells[i].Row) || !bytes.Equal(cell.Family, cells[i].Family) || !bytes.Equal(cell.Qualifier, cells[i].Qualifier) ||
+			!bytes.Equal(cell.Value, cells[i].Value) || *cell.Timestamp != uint64(cells[i].Timestamp) || *cell.CellType != cellTypePut {
+			t.Errorf("Cell %d is %v instead of %+v", i, cell, cells[i])
+		}
+	}
+}
+
+func TestEmptyResult(t *testing.T) {
+	data := EncodeResult(nil)
+	if !bytes.Equal(data, []byte{0}) {
+		t.Errorf("Encoded %x for an empty Result", data)
+	}
+	cells, err := DecodeResult(data)
+	if err != nil || len(cells) != 0 {
+		t.Errorf("Decoded %+v, %v for an empty Result", cells, err)
+	}
+}
+
+func TestDecodeResultInvalid(t *testing.T) {
+	fixture, err := hex.DecodeString(testResultHex)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range [][]byte{
+		nil,
+		fixture[:len(fixture)-1],
+		append(append([]byte(nil), fixture...), 0),
+		// A cell whose length is past the end of the Result.
+		{2, 0x0a, 5},
+		// A truncated varint.
+		{2, 0x20, 0x80},
+		// Unsupported wire type.
+		{2, 0x0b, 0},
+	} {
+		if cells, err := DecodeResult(data); err == nil {
+			t.Errorf("Expected an error decoding %x, got %+v", data, cells)
+		}
+	}
+}
+
+func TestRowKey(t *testing.T) {
+	for _, row := range [][]byte{{}, []byte("row"), {0, 0xff, 0x80}} {
+		key := EncodeRowKey(row)
+		if expected := append([]byte{0, 0, 0, byte(len(row))}, row...); !bytes.Equal(key, expected) {
+			t.Errorf("Encoded %x instead of %x", key, expected)
+		}
+		decoded, err := DecodeRowKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded, row) {
+			t.Errorf("Decoded %x instead of %x", decoded, row)
+		}
+	}
+
+	for _, key := range [][]byte{nil, {0, 0, 0}, {0, 0, 0, 2, 'a'}, {0, 0, 0, 0, 'a'}} {
+		if _, err := DecodeRowKey(key); err == nil {
+			t.Errorf("Expected an error decoding the row key %x", key)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package seqfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// maxLength is the largest length of a string, buffer or record, which Hadoop reads into Java arrays.
+const maxLength = math.MaxInt32
+
+// preallocatedLength is the largest length whose buffer is allocated before reading it.
+const preallocatedLength = 1 << 20
+
+// ErrSyncMismatch is returned when a sync marker does not match the one in the header.
+var ErrSyncMismatch = errors.New("sync marker does not match the header")
+
+// Reader reads the records of a SequenceFile.
+type Reader struct {
+	r      *bufio.Reader
+	header Header
+	codec  Codec
+
+	key, value []byte
+	err        error
+
+	// The records left in the current block, when block compressed.
+	blockRecords   int64
+	blockKeyLens   *bytes.Reader
+	blockKeys      *bytes.Reader
+	blockValueLens *bytes.Reader
+	blockValues    *bytes.Reader
+}
+
+// NewReader reads the header of the SequenceFile from r and returns the Reader for its records.
+func NewReader(r io.Reader) (*Reader, error) {
+	sr := &Reader{r: bufio.NewReader(r)}
+	if err := sr.readHeader(); err != nil {
+		return nil, err
+	}
+
+	return sr, nil
+}
+
+// Header returns the header of the SequenceFile.
+func (r *Reader) Header() Header {
+	return r.header
+}
+
+func (r *Reader) readHeader() error {
+	var buf [4]byte
+	if _, err := io.ReadFull(r.r, buf[:]); err != nil {
+		return unexpectedEOF(err)
+	}
+	if !bytes.Equal(buf[:3], magic) {
+		return errors.New("not a SequenceFile")
+	}
+	if buf[3] != version {
+		return fmt.Errorf("unsupported SequenceFile version %d", buf[3])
+	}
+
+	var err error
+	if r.header.KeyClassName, err = r.readText(); err != nil {
+		return err
+	}
+	if r.header.ValueClassName, err = r.readText(); err != nil {
+		return err
+	}
+
+	compressed, err := r.readBool()
+	if err != nil {
+		return err
+	}
+	blockCompressed, err := r.readBool()
+	if err != nil {
+		return err
+	}
+	switch {
+	case blockCompressed:
+		r.header.Compression = BlockCompression
+	case compressed:
+		r.header.Compression = RecordCompression
+	}
+	if r.header.Compression != NoCompression {
+		if r.header.CodecClassName, err = r.readText(); err != nil {
+			return err
+		}
+		if r.codec, err = CodecByClassName(r.header.CodecClassName); err != nil {
+			return err
+		}
+	}
+
+	count, err := r.readInt32()
+	if err != nil {
+		return err
+	}
+	if count < 0 {
+		return fmt.Errorf("invalid metadata count %d", count)
+	}
+	// The count is not used as a size hint, since it may be corrupt.
+	r.header.Metadata = map[string]string{}
+	for i := int32(0); i < count; i++ {
+		key, err := r.readText()
+		if err != nil {
+			return err
+		}
+		value, err := r.readText()
+		if err != nil {
+			return err
+		}
+		r.header.Metadata[key] = value
+	}
+
+	if _, err := io.ReadFull(r.r, r.header.Sync[:]); err != nil {
+		return unexpectedEOF(err)
+	}
+
+	return nil
+}
+
+// Next reads the next record, which is then available through Key and Value.
+// It returns false when there are no more records or an error happened,
+// which is then returned by Err.
+func (r *Reader) Next() bool {
+	if r.err != nil {
+		return false
+	}
+
+	if r.header.Compression == BlockCompression {
+		return r.nextInBlock()
+	}
+
+	// The file can only end between records.
+	if _, err := r.r.Peek(1); err == io.EOF {
+		return false
+	}
+
+	length, err := r.readInt32()
+	if err != nil {
+		r.err = err
+		return false
+	}
+
+	if length == syncEscape {
+		if r.err = r.readSync(); r.err != nil {
+			return false
+		}
+		if length, r.err = r.readInt32(); r.err != nil {
+			return false
+		}
+	}
+
+	keyLength, err := r.readInt32()
+	if err != nil {
+		r.err = err
+		return false
+	}
+	if keyLength < 0 || length < keyLength {
+		r.err = fmt.Errorf("invalid record with length %d and key length %d", length, keyLength)
+		return false
+	}
+
+	record, err := r.readBytes(int64(length))
+	if err != nil {
+		r.err = err
+		return false
+	}
+	r.key, r.value = record[:keyLength], record[keyLength:]
+
+	if r.header.Compression == RecordCompression {
+		if r.value, r.err = r.codec.Decompress(r.value); r.err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r *Reader) nextInBlock() bool {
+	if r.blockRecords == 0 {
+		// The file can only end between blocks.
+		if _, err := r.r.Peek(1); err == io.EOF {
+			return false
+		}
+		if r.err = r.readBlock(); r.err != nil {
+			return false
+		}
+	}
+
+	if r.key, r.err = readBlockEntry(r.blockKeyLens, r.blockKeys); r.err != nil {
+		return false
+	}
+	if r.value, r.err = readBlockEntry(r.blockValueLens, r.blockValues); r.err != nil {
+		return false
+	}
+	r.blockRecords--
+
+	return true
+}
+
+// readBlock reads the next block, which starts with a sync marker.
+func (r *Reader) readBlock() error {
+	escape, err := r.readInt32()
+	if err != nil {
+		return err
+	}
+	if escape != syncEscape {
+		return fmt.Errorf("expected a sync marker at the start of the block, got %d", escape)
+	}
+	if err := r.readSync(); err != nil {
+		return err
+	}
+
+	if r.blockRecords, err = ReadVLong(r.r); err != nil {
+		return unexpectedEOF(err)
+	}
+	if r.blockRecords <= 0 {
+		return fmt.Errorf("invalid number of records %d in block", r.blockRecords)
+	}
+
+	buffers := make([]*bytes.Reader, 4)
+	for i := range buffers {
+		length, err := ReadVLong(r.r)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if length < 0 || length > maxLength {
+			return fmt.Errorf("invalid block buffer length %d", length)
+		}
+
+		compressed, err := r.readBytes(length)
+		if err != nil {
+			return err
+		}
+
+		buf, err := r.codec.Decompress(compressed)
+		if err != nil {
+			return err
+		}
+		buffers[i] = bytes.NewReader(buf)
+	}
+	r.blockKeyLens, r.blockKeys, r.blockValueLens, r.blockValues = buffers[0], buffers[1], buffers[2], buffers[3]
+
+	return nil
+}
+
+// readBlockEntry reads the next key or value of a block from its buffers of lengths and data.
+func readBlockEntry(lengths, data *bytes.Reader) ([]byte, error) {
+	length, err := ReadVLong(lengths)
+	if err != nil {
+		return nil, fmt.Errorf("truncated block lengths: %v", err)
+	}
+	if length < 0 || length > int64(data.Len()) {
+		return nil, fmt.Errorf("invalid length %d in block", length)
+	}
+
+	entry := make([]byte, length)
+	data.Read(entry)
+	return entry, nil
+}
+
+// Key returns the serialized key of the current record.
+func (r *Reader) Key() []byte {
+	return r.key
+}
+
+// Value returns the serialized value of the current record.
+func (r *Reader) Value() []byte {
+	return r.value
+}
+
+// Err returns the error which stopped Next, if any.
+func (r *Reader) Err() error {
+	return r.err
+}
+
+func (r *Reader) readSync() error {
+	var sync [SyncSize]byte
+	if _, err := io.ReadFull(r.r, sync[:]); err != nil {
+		return unexpectedEOF(err)
+	}
+	if sync != r.header.Sync {
+		return ErrSyncMismatch
+	}
+	return nil
+}
+
+func (r *Reader) readInt32() (int32, error) {
+	var buf [4]byte
+	if _, err := io.ReadFull(r.r, buf[:]); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	return int32(binary.BigEndian.Uint32(buf[:])), nil
+}
+
+func (r *Reader) readBool() (bool, error) {
+	b, err := r.r.ReadByte()
+	if err != nil {
+		return false, unexpectedEOF(err)
+	}
+	return b != 0, nil
+}
+
+// readText reads a string written by Hadoop's Text.writeString.
+func (r *Reader) readText() (string, error) {
+	length, err := ReadVLong(r.r)
+	if err != nil {
+		return "", unexpectedEOF(err)
+	}
+	if length < 0 || length > maxLength {
+		return "", fmt.Errorf("invalid string length %d", length)
+	}
+
+	buf, err := r.readBytes(length)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// readBytes reads the next length bytes. Past preallocatedLength, the buffer grows with the bytes read
+// rather than being allocated upfront, so that a corrupt length fails at the end of the file instead of allocating it.
+func (r *Reader) readBytes(length int64) ([]byte, error) {
+	if length <= preallocatedLength {
+		buf := make([]byte, length)
+		if _, err := io.ReadFull(r.r, buf); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		return buf, nil
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r.r, length); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,366 @@
+package seqfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "Update the golden SequenceFiles in testdata")
+
+var testSync = [SyncSize]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+type testRecord struct {
+	key, value []byte
+}
+
+// testRecords returns enough records for the uncompressed and record compressed files to have sync markers.
+// They are rows serialized like in the backups, with up to 4 cells.
+func testRecords() []testRecord {
+	records := make([]testRecord, 200)
+	for i := range records {
+		row := []byte(fmt.Sprintf("row-%03d", i))
+		cells := make([]Cell, i%5)
+		for j := range cells {
+			cells[j] = Cell{
+				Row:       row,
+				Family:    []byte("f"),
+				Qualifier: []byte(fmt.Sprintf("q%d", j)),
+				Timestamp: int64(1558000000000 + i),
+				Value:     []byte(strings.Repeat(fmt.Sprintf("value %d ", i), j)),
+			}
+		}
+		records[i].key = EncodeRowKey(row)
+		records[i].value = EncodeResult(cells)
+	}
+	return records
+}
+
+// testHeaders returns the headers of the golden SequenceFiles, keyed by the names of the files.
+func testHeaders() map[string]Header {
+	headers := map[string]Header{"none": {Compression: NoCompression}}
+	for name, className := range map[string]string{
+		"default": DefaultCodecClassName,
+		"deflate": DeflateCodecClassName,
+		"gzip":    GzipCodecClassName,
+		"snappy":  SnappyCodecClassName,
+	} {
+		headers["record-"+name] = Header{Compression: RecordCompression, CodecClassName: className}
+		headers["block-"+name] = Header{Compression: BlockCompression, CodecClassName: className}
+	}
+
+	for name, header := range headers {
+		header.KeyClassName = ImmutableBytesWritableClassName
+		header.ValueClassName = ResultClassName
+		header.Metadata = map[string]string{"created-by": "bigtable-backup"}
+		header.Sync = testSync
+		headers[name] = header
+	}
+	return headers
+}
+
+func writeRecords(t *testing.T, header Header, records []testRecord) []byte {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range records {
+		if err := w.Append(record.key, record.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if header.Compression != BlockCompression && w.Size() != int64(buf.Len()) {
+		t.Errorf("Writer reports a size of %d instead of %d", w.Size(), buf.Len())
+	}
+	return buf.Bytes()
+}
+
+// readRecords reads all the records of a SequenceFile, and returns the error which stopped the reader.
+func readRecords(data []byte) (*Header, []testRecord, error) {
+	r, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var records []testRecord
+	for r.Next() {
+		records = append(records, testRecord{key: r.Key(), value: r.Value()})
+	}
+	header := r.Header()
+	return &header, records, r.Err()
+}
+
+func checkRecords(t *testing.T, name string, records, expected []testRecord) {
+	if len(records) != len(expected) {
+		t.Fatalf("%s: read %d records instead of %d", name, len(records), len(expected))
+	}
+	for i := range records {
+		if !bytes.Equal(records[i].key, expected[i].key) || !bytes.Equal(records[i].value, expected[i].value) {
+			t.Fatalf("%s: record %d is %q=%q instead of %q=%q", name, i, records[i].key, records[i].value, expected[i].key, expected[i].value)
+		}
+	}
+}
+
+func TestGolden(t *testing.T) {
+	records := testRecords()
+	for name, header := range testHeaders() {
+		path := filepath.Join("testdata", name+".seq")
+		written := writeRecords(t, header, records)
+		if *update {
+			if err := ioutil.WriteFile(path, written, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		golden, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(written, golden) {
+			t.Errorf("%s: written SequenceFile differs from %s", name, path)
+		}
+
+		readHeader, read, err := readRecords(golden)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(*readHeader, header) {
+			t.Errorf("%s: read header %+v instead of %+v", name, *readHeader, header)
+		}
+		checkRecords(t, name, read, records)
+		for _, record := range read {
+			if _, err := DecodeRowKey(record.key); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if _, err := DecodeResult(record.value); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+	}
+}
+
+// TestReadHadoopFile reads an uncompressed SequenceFile built by hand from the format written by Hadoop's SequenceFile.Writer.
+func TestReadHadoopFile(t *testing.T) {
+	var data []byte
+	data = append(data, 'S', 'E', 'Q', 6)
+	data = append(data, 3, 'K', 'e', 'y', 5, 'V', 'a', 'l', 'u', 'e')
+	// Neither record nor block compressed.
+	data = append(data, 0, 0)
+	// One metadata entry.
+	data = append(data, 0, 0, 0, 1, 1, 'k', 1, 'v')
+	data = append(data, testSync[:]...)
+	// Record lengths, then key and value lengths.
+	data = append(data, 0, 0, 0, 5, 0, 0, 0, 2, 'a', 'b', 'c', 'd', 'e')
+	// A sync marker before the next record.
+	data = append(data, 0xff, 0xff, 0xff, 0xff)
+	data = append(data, testSync[:]...)
+	data = append(data, 0, 0, 0, 1, 0, 0, 0, 1, 'f')
+
+	header, records, err := readRecords(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedHeader := Header{KeyClassName: "Key", ValueClassName: "Value", Metadata: map[string]string{"k": "v"}, Sync: testSync}
+	if !reflect.DeepEqual(*header, expectedHeader) {
+		t.Errorf("Read header %+v instead of %+v", *header, expectedHeader)
+	}
+	checkRecords(t, "hadoop", records, []testRecord{{key: []byte("ab"), value: []byte("cde")}, {key: []byte("f"), value: []byte{}}})
+}
+
+func TestRoundTrip(t *testing.T) {
+	// Large values span several snappy chunks and make the blocks be written before the writer is closed.
+	records := testRecords()
+	for i := 0; i < 5; i++ {
+		records = append(records, testRecord{key: []byte(fmt.Sprintf("large-%d", i)), value: testData(400000 + i)})
+	}
+	records = append(records, testRecord{key: []byte{}, value: []byte{}})
+
+	for name, header := range testHeaders() {
+		_, read, err := readRecords(writeRecords(t, header, records))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		checkRecords(t, name, read, records)
+	}
+}
+
+func TestRoundTripNoRecords(t *testing.T) {
+	for name, header := range testHeaders() {
+		_, read, err := readRecords(writeRecords(t, header, nil))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		checkRecords(t, name, read, nil)
+	}
+}
+
+// TestTruncated checks that truncated SequenceFiles are never read as valid files with fewer records,
+// unless they are truncated between two records or blocks.
+func TestTruncated(t *testing.T) {
+	records := testRecords()
+	for name, header := range testHeaders() {
+		data := writeRecords(t, header, records)
+		boundaries := recordBoundaries(t, header, records)
+
+		// The file is truncated at every offset of the header, and at the start, middle and end of every record or block.
+		var lengths []int
+		for i := 1; i < len(boundaries); i++ {
+			start, end := boundaries[i-1], boundaries[i]
+			if i == 1 {
+				for length := 0; length < start; length++ {
+					lengths = append(lengths, length)
+				}
+			}
+			lengths = append(lengths, start, start+1, (start+end)/2, end-1)
+		}
+
+		for _, length := range lengths {
+			_, read, err := readRecords(data[:length])
+			if isBoundary(boundaries, length) {
+				if err != nil {
+					t.Fatalf("%s: unexpected error reading the first %d bytes: %v", name, length, err)
+				}
+				continue
+			}
+			if err == nil {
+				t.Fatalf("%s: no error reading the first %d of %d bytes, %d records read", name, length, len(data), len(read))
+			}
+			checkRecords(t, name, read, records[:len(read)])
+		}
+	}
+}
+
+func isBoundary(boundaries []int, offset int) bool {
+	for _, boundary := range boundaries {
+		if boundary == offset {
+			return true
+		}
+	}
+	return false
+}
+
+// recordBoundaries returns the increasing offsets after the header, every record and every block of the SequenceFile.
+func recordBoundaries(t *testing.T, header Header, records []testRecord) []int {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Blocks are only written once they are large enough, or when the writer is closed.
+	boundaries := []int{buf.Len()}
+	for _, record := range records {
+		if err := w.Append(record.key, record.value); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() != boundaries[len(boundaries)-1] {
+			boundaries = append(boundaries, buf.Len())
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != boundaries[len(boundaries)-1] {
+		boundaries = append(boundaries, buf.Len())
+	}
+	return boundaries
+}
+
+func TestSyncMismatch(t *testing.T) {
+	records := testRecords()
+	for name, header := range testHeaders() {
+		data := writeRecords(t, header, records)
+
+		// Corrupt the first sync marker after the one of the header.
+		headerLength := bytes.Index(data, testSync[:]) + SyncSize
+		i := bytes.Index(data[headerLength:], testSync[:])
+		if i < 0 {
+			t.Fatalf("%s: no sync marker after the header", name)
+		}
+		corrupted := append([]byte(nil), data...)
+		corrupted[headerLength+i+SyncSize-1]++
+
+		_, read, err := readRecords(corrupted)
+		if err != ErrSyncMismatch {
+			t.Fatalf("%s: expected a sync mismatch, got %v", name, err)
+		}
+		checkRecords(t, name, read, records[:len(read)])
+	}
+}
+
+func TestInvalidHeader(t *testing.T) {
+	for _, data := range [][]byte{
+		nil,
+		[]byte("SEQ"),
+		[]byte("TXT\x06"),
+		[]byte("SEQ\x05"),
+		append([]byte("SEQ\x06\x01a\x01b\x01\x00\x03Foo"), make([]byte, 4+SyncSize)...),
+		// Corrupt string lengths: too large for a Java array, or larger than the file.
+		AppendVLong([]byte("SEQ\x06"), math.MaxInt64),
+		AppendVLong([]byte("SEQ\x06"), math.MinInt64),
+		AppendVLong([]byte("SEQ\x06"), math.MaxInt32+1),
+		AppendVLong([]byte("SEQ\x06\x01a"), math.MaxInt32),
+		// A corrupt metadata count.
+		append([]byte("SEQ\x06\x01a\x01b\x00\x00\x7f\xff\xff\xff"), make([]byte, SyncSize)...),
+	} {
+		if _, err := NewReader(bytes.NewReader(data)); err == nil {
+			t.Errorf("Expected an error reading the header %q", data)
+		} else if len(data) < 4 && err != io.ErrUnexpectedEOF {
+			t.Errorf("Expected an unexpected EOF reading the header %q, got %v", data, err)
+		}
+	}
+}
+
+// TestCorruptLengths checks that corrupt record and block buffer lengths are errors rather than allocations of their length.
+func TestCorruptLengths(t *testing.T) {
+	records := testRecords()
+	for name, header := range testHeaders() {
+		data := writeRecords(t, header, records)
+		headerLength := bytes.Index(data, testSync[:]) + SyncSize
+
+		var corruptions [][]byte
+		if header.Compression == BlockCompression {
+			// The block starts with a sync marker and its number of records, followed by the length of its buffer of key lengths.
+			offset := headerLength + 4 + SyncSize
+			offset += vlongSize(t, data[offset:])
+			for _, length := range []int64{math.MaxInt64, math.MinInt64, math.MaxInt32 + 1, math.MaxInt32} {
+				corrupted := AppendVLong(append([]byte(nil), data[:offset]...), length)
+				corruptions = append(corruptions, append(corrupted, data[offset+vlongSize(t, data[offset:]):]...))
+			}
+		} else {
+			// The first record starts with its length and the length of its key.
+			for _, lengths := range [][2]uint32{{math.MaxInt32, 7}, {math.MaxInt32, math.MaxInt32}, {1 << 31, 7}, {7, 1 << 31}} {
+				corrupted := append([]byte(nil), data...)
+				binary.BigEndian.PutUint32(corrupted[headerLength:], lengths[0])
+				binary.BigEndian.PutUint32(corrupted[headerLength+4:], lengths[1])
+				corruptions = append(corruptions, corrupted)
+			}
+		}
+
+		for i, corrupted := range corruptions {
+			if _, _, err := readRecords(corrupted); err == nil {
+				t.Errorf("%s: no error reading corruption %d", name, i)
+			}
+		}
+	}
+}
+
+func vlongSize(t *testing.T, data []byte) int {
+	r := bytes.NewReader(data)
+	if _, err := ReadVLong(r); err != nil {
+		t.Fatal(err)
+	}
+	return len(data) - r.Len()
+}
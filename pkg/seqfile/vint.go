@@ -0,0 +1,72 @@
+package seqfile
+
+import (
+	"io"
+)
+
+// AppendVLong appends i encoded like Hadoop's WritableUtils.writeVLong.
+func AppendVLong(buf []byte, i int64) []byte {
+	if i >= -112 && i <= 127 {
+		return append(buf, byte(i))
+	}
+
+	length := -112
+	if i < 0 {
+		i = ^i
+		length = -120
+	}
+	for tmp := i; tmp != 0; tmp >>= 8 {
+		length--
+	}
+	buf = append(buf, byte(length))
+
+	if length < -120 {
+		length = -(length + 120)
+	} else {
+		length = -(length + 112)
+	}
+	for idx := length; idx != 0; idx-- {
+		buf = append(buf, byte(i>>uint((idx-1)*8)))
+	}
+
+	return buf
+}
+
+// ReadVLong reads an integer encoded like Hadoop's WritableUtils.writeVLong.
+func ReadVLong(r io.ByteReader) (int64, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	first := int8(b)
+	if first >= -112 {
+		return int64(first), nil
+	}
+
+	length := -111 - int(first)
+	if first < -120 {
+		length = -119 - int(first)
+	}
+
+	var i int64
+	for idx := 0; idx < length-1; idx++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		i = i<<8 | int64(b)
+	}
+
+	if first < -120 {
+		i = ^i
+	}
+	return i, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,57 @@
+package seqfile
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"testing"
+)
+
+func TestVLong(t *testing.T) {
+	// Encodings of Hadoop's WritableUtils.writeVLong at the boundaries of its single byte and multi-byte forms.
+	for _, tc := range []struct {
+		i       int64
+		encoded []byte
+	}{
+		{i: 0, encoded: []byte{0x00}},
+		{i: 127, encoded: []byte{0x7f}},
+		{i: -112, encoded: []byte{0x90}},
+		{i: -1, encoded: []byte{0xff}},
+		{i: 128, encoded: []byte{0x8f, 0x80}},
+		{i: 255, encoded: []byte{0x8f, 0xff}},
+		{i: 256, encoded: []byte{0x8e, 0x01, 0x00}},
+		{i: -113, encoded: []byte{0x87, 0x70}},
+		{i: -129, encoded: []byte{0x87, 0x80}},
+		{i: -257, encoded: []byte{0x86, 0x01, 0x00}},
+		{i: math.MaxInt32, encoded: []byte{0x8c, 0x7f, 0xff, 0xff, 0xff}},
+		{i: math.MaxInt64, encoded: []byte{0x88, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{i: math.MinInt64, encoded: []byte{0x80, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+	} {
+		encoded := AppendVLong([]byte{0xaa}, tc.i)
+		if !bytes.Equal(encoded[1:], tc.encoded) || encoded[0] != 0xaa {
+			t.Errorf("Encoded %d as %x instead of %x", tc.i, encoded[1:], tc.encoded)
+		}
+
+		r := bytes.NewReader(tc.encoded)
+		i, err := ReadVLong(r)
+		if err != nil {
+			t.Fatalf("Error reading %x: %v", tc.encoded, err)
+		}
+		if i != tc.i || r.Len() != 0 {
+			t.Errorf("Read %x as %d with %d bytes left instead of %d", tc.encoded, i, r.Len(), tc.i)
+		}
+	}
+}
+
+func TestReadVLongTruncated(t *testing.T) {
+	if _, err := ReadVLong(bytes.NewReader(nil)); err != io.EOF {
+		t.Errorf("Expected EOF reading nothing, got %v", err)
+	}
+
+	encoded := AppendVLong(nil, math.MaxInt64)
+	for length := 1; length < len(encoded); length++ {
+		if _, err := ReadVLong(bytes.NewReader(encoded[:length])); err != io.ErrUnexpectedEOF {
+			t.Errorf("Expected an unexpected EOF reading %x, got %v", encoded[:length], err)
+		}
+	}
+}
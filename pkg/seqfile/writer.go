@@ -0,0 +1,248 @@
+// Package seqfile reads and writes Hadoop SequenceFiles, which is the format
+// of the backups created by the Cloud_Bigtable_to_GCS_SequenceFile template.
+//
+// SequenceFiles can be uncompressed, record compressed, where every value is
+// compressed on its own, or block compressed, where the keys and values of
+// many records are compressed together.
+package seqfile
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	version = 6
+
+	// SyncSize is the size of the sync marker.
+	SyncSize = 16
+	// syncEscape is written instead of a record length before a sync marker.
+	syncEscape = -1
+	// syncInterval is the number of bytes between sync markers, like in Hadoop.
+	syncInterval = 100 * (4 + SyncSize)
+	// defaultBlockSize is the size of the records after which a block is written, Hadoop's io.seqfile.compress.blocksize.
+	defaultBlockSize = 1000000
+)
+
+var magic = []byte("SEQ")
+
+// CompressionType is the type of compression of a SequenceFile.
+type CompressionType int
+
+// The types of compression.
+const (
+	NoCompression CompressionType = iota
+	RecordCompression
+	BlockCompression
+)
+
+func (c CompressionType) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case RecordCompression:
+		return "record"
+	case BlockCompression:
+		return "block"
+	default:
+		return fmt.Sprintf("CompressionType(%d)", int(c))
+	}
+}
+
+// Header is the header of a SequenceFile.
+type Header struct {
+	KeyClassName   string
+	ValueClassName string
+	Compression    CompressionType
+	// CodecClassName is the class name of the Hadoop compression codec, when compressed.
+	CodecClassName string
+	Metadata       map[string]string
+	Sync           [SyncSize]byte
+}
+
+// Writer writes records to a SequenceFile.
+type Writer struct {
+	w            io.Writer
+	header       Header
+	codec        Codec
+	size         int64
+	lastSyncSize int64
+	err          error
+
+	// The records buffered for the next block, when block compressed.
+	blockRecords   int
+	blockKeyLens   []byte
+	blockKeys      []byte
+	blockValueLens []byte
+	blockValues    []byte
+}
+
+// NewWriter writes the header of a new SequenceFile to w and returns the Writer for its records.
+func NewWriter(w io.Writer, header Header) (*Writer, error) {
+	if header.Sync == [SyncSize]byte{} {
+		if _, err := rand.Read(header.Sync[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	sw := &Writer{w: w, header: header}
+	if header.Compression != NoCompression {
+		codec, err := CodecByClassName(header.CodecClassName)
+		if err != nil {
+			return nil, err
+		}
+		sw.codec = codec
+	}
+
+	sw.writeHeader()
+	if sw.err != nil {
+		return nil, sw.err
+	}
+	sw.lastSyncSize = sw.size
+
+	return sw, nil
+}
+
+// Header returns the header of the SequenceFile.
+func (w *Writer) Header() Header {
+	return w.header
+}
+
+// Size returns the number of bytes written so far, which does not include the
+// records buffered for the next block.
+func (w *Writer) Size() int64 {
+	return w.size
+}
+
+func (w *Writer) writeHeader() {
+	w.write(magic)
+	w.write([]byte{version})
+	w.writeText(w.header.KeyClassName)
+	w.writeText(w.header.ValueClassName)
+	w.writeBool(w.header.Compression != NoCompression)
+	w.writeBool(w.header.Compression == BlockCompression)
+	if w.header.Compression != NoCompression {
+		w.writeText(w.header.CodecClassName)
+	}
+
+	keys := make([]string, 0, len(w.header.Metadata))
+	for key := range w.header.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	w.writeInt32(int32(len(keys)))
+	for _, key := range keys {
+		w.writeText(key)
+		w.writeText(w.header.Metadata[key])
+	}
+
+	w.write(w.header.Sync[:])
+}
+
+// Append appends a record with the serialized key and value.
+func (w *Writer) Append(key, value []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+
+	switch w.header.Compression {
+	case BlockCompression:
+		w.blockRecords++
+		w.blockKeyLens = AppendVLong(w.blockKeyLens, int64(len(key)))
+		w.blockKeys = append(w.blockKeys, key...)
+		w.blockValueLens = AppendVLong(w.blockValueLens, int64(len(value)))
+		w.blockValues = append(w.blockValues, value...)
+
+		if len(w.blockKeys)+len(w.blockValues) >= defaultBlockSize {
+			w.writeBlock()
+		}
+		return w.err
+
+	case RecordCompression:
+		value, w.err = w.codec.Compress(value)
+		if w.err != nil {
+			return w.err
+		}
+	}
+
+	if w.size >= w.lastSyncSize+syncInterval {
+		w.writeSync()
+	}
+
+	w.writeInt32(int32(len(key) + len(value)))
+	w.writeInt32(int32(len(key)))
+	w.write(key)
+	w.write(value)
+
+	return w.err
+}
+
+// Close writes the records buffered for the next block. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.header.Compression == BlockCompression && w.blockRecords > 0 {
+		w.writeBlock()
+	}
+	return w.err
+}
+
+// writeBlock writes the buffered records as a block, which always starts with a sync marker.
+func (w *Writer) writeBlock() {
+	w.writeSync()
+	w.write(AppendVLong(nil, int64(w.blockRecords)))
+	for _, buf := range [][]byte{w.blockKeyLens, w.blockKeys, w.blockValueLens, w.blockValues} {
+		if w.err != nil {
+			return
+		}
+
+		var compressed []byte
+		compressed, w.err = w.codec.Compress(buf)
+		w.write(AppendVLong(nil, int64(len(compressed))))
+		w.write(compressed)
+	}
+
+	w.blockRecords = 0
+	w.blockKeyLens = w.blockKeyLens[:0]
+	w.blockKeys = w.blockKeys[:0]
+	w.blockValueLens = w.blockValueLens[:0]
+	w.blockValues = w.blockValues[:0]
+}
+
+func (w *Writer) writeSync() {
+	w.writeInt32(syncEscape)
+	w.write(w.header.Sync[:])
+	w.lastSyncSize = w.size
+}
+
+func (w *Writer) write(p []byte) {
+	if w.err != nil {
+		return
+	}
+
+	var n int
+	n, w.err = w.w.Write(p)
+	w.size += int64(n)
+}
+
+func (w *Writer) writeInt32(i int32) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(i))
+	w.write(buf[:])
+}
+
+func (w *Writer) writeBool(b bool) {
+	if b {
+		w.write([]byte{1})
+	} else {
+		w.write([]byte{0})
+	}
+}
+
+// writeText writes a string the way Hadoop's Text.writeString does.
+func (w *Writer) writeText(s string) {
+	w.write(AppendVLong(nil, int64(len(s))))
+	w.write([]byte(s))
+}